@@ -33,8 +33,9 @@ func main() {
 			log.Printf("connection status %d", s)
 		}
 	}()
-	tlsConf := tls.Config{InsecureSkipVerify: true}
-	c, err := xmpp.NewClient(&jid, *pw, tlsConf, nil, xmpp.Presence{}, stat)
+	tlsConf := tls.Config{}
+	c, err := xmpp.NewClient(&jid, *pw, tlsConf, nil, nil, xmpp.Presence{},
+		stat)
 	if err != nil {
 		log.Fatalf("NewClient(%v): %v", jid, err)
 	}
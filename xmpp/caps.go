@@ -0,0 +1,359 @@
+package xmpp
+
+// This file contains support for entity capabilities, XEP-0115.
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const NsCaps = "http://jabber.org/protocol/caps"
+
+// The hash we use for our own capabilities.
+const capsHash = "sha-1"
+
+// How long to wait for a contact to tell us what its capabilities
+// hash means.
+const capsQueryTimeout = 30 * time.Second
+
+// The hash functions we can verify, by their IANA names.
+var capsHashes = map[string]func() hash.Hash{
+	"sha-1":   sha1.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// The capabilities element carried in presence.
+type Caps struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/caps c"`
+	Hash    string   `xml:"hash,attr"`
+	Node    string   `xml:"node,attr"`
+	Ver     string   `xml:"ver,attr"`
+}
+
+// A CapsCache remembers what each capabilities hash stands for, so
+// each only needs to be looked up once. Entries are keyed by the hash
+// function's name as well as the verification string. Only verified
+// entries are stored.
+type CapsCache interface {
+	// Returns the disco#info for the hash, or nil if it's unknown.
+	Get(hash, ver string) (*DiscoInfo, error)
+	Put(hash, ver string, info *DiscoInfo) error
+}
+
+// A CapsCache which is forgotten when the program exits.
+type MemoryCapsCache struct {
+	lock sync.Mutex
+	m    map[capsKey]*DiscoInfo
+}
+
+// Identifies a capabilities hash.
+type capsKey struct {
+	hash, ver string
+}
+
+var _ CapsCache = &MemoryCapsCache{}
+
+// EntityCaps advertises our capabilities in our outgoing presence, and
+// keeps track of the capabilities of the entities we receive presence
+// from. Include its Extension in the list given to NewClient.
+type EntityCaps struct {
+	Extension
+	node  string
+	cache CapsCache
+	lock  sync.Mutex
+	// What each full JID last advertised.
+	jids map[JID]Caps
+	// Hashes we're looking up.
+	pending map[capsKey]bool
+	client  *Client
+}
+
+// Creates the entity capabilities extension. Node identifies this
+// software, and should be a URL for it. If cache is nil, a
+// MemoryCapsCache is used.
+func NewEntityCaps(node string, cache CapsCache) *EntityCaps {
+	if cache == nil {
+		cache = &MemoryCapsCache{}
+	}
+	ec := &EntityCaps{node: node, cache: cache}
+	ec.jids = make(map[JID]Caps)
+	ec.pending = make(map[capsKey]bool)
+	ec.StanzaTypes = make(map[xml.Name]reflect.Type)
+	ec.StanzaTypes[xml.Name{Space: NsCaps, Local: "c"}] =
+		reflect.TypeOf(Caps{})
+	ec.RecvFilter = ec.recvFilter
+	ec.SendFilter = ec.sendFilter
+	ec.Init = func(cl *Client) {
+		ec.client = cl
+		cl.Disco.AddFeature(NsCaps)
+	}
+	return ec
+}
+
+// Computes the verification string for a disco#info result. Returns
+// an error if the hash function is unknown or the result is
+// ill-formed. XEP-0115, section 5.
+func CapsVer(hashName string, info *DiscoInfo) (string, error) {
+	newHash, ok := capsHashes[hashName]
+	if !ok {
+		return "", fmt.Errorf("unknown caps hash %q", hashName)
+	}
+	var b strings.Builder
+
+	ids := make([]string, 0, len(info.Identities))
+	for _, id := range info.Identities {
+		ids = append(ids, id.Category+"/"+id.Type+"/"+id.Lang+"/"+
+			id.Name)
+	}
+	if err := sortUnique(ids); err != nil {
+		return "", fmt.Errorf("identity %v", err)
+	}
+	for _, id := range ids {
+		b.WriteString(id + "<")
+	}
+
+	vars := make([]string, 0, len(info.Features))
+	for _, f := range info.Features {
+		vars = append(vars, f.Var)
+	}
+	if err := sortUnique(vars); err != nil {
+		return "", fmt.Errorf("feature %v", err)
+	}
+	for _, v := range vars {
+		b.WriteString(v + "<")
+	}
+
+	forms := make(map[string]*Form)
+	var types []string
+	for i := range info.Forms {
+		f := &info.Forms[i]
+		fld := f.Field(formTypeVar)
+		if fld == nil || fld.Type != "hidden" {
+			// Not an extension form, so not our concern.
+			continue
+		}
+		typ := f.FormType()
+		for _, v := range fld.Values {
+			if v != typ {
+				return "", fmt.Errorf("form with types %v",
+					fld.Values)
+			}
+		}
+		if forms[typ] != nil {
+			return "", fmt.Errorf("two forms of type %s", typ)
+		}
+		forms[typ] = f
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	for _, typ := range types {
+		b.WriteString(typ + "<")
+		fields := append([]FormField(nil), forms[typ].Fields...)
+		sort.Slice(fields, func(i, j int) bool {
+			return fields[i].Var < fields[j].Var
+		})
+		for _, fld := range fields {
+			if fld.Var == formTypeVar {
+				continue
+			}
+			b.WriteString(fld.Var + "<")
+			values := append([]string(nil), fld.Values...)
+			sort.Strings(values)
+			for _, v := range values {
+				b.WriteString(v + "<")
+			}
+		}
+	}
+
+	h := newHash()
+	h.Write([]byte(b.String()))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// Sort a list, complaining if anything appears twice.
+func sortUnique(list []string) error {
+	sort.Strings(list)
+	for i := 1; i < len(list); i++ {
+		if list[i] == list[i-1] {
+			return fmt.Errorf("%q appears twice", list[i])
+		}
+	}
+	return nil
+}
+
+// Our own current disco#info, and its verification string.
+func (ec *EntityCaps) localVer() (*DiscoInfo, string) {
+	info := ec.client.Disco.LocalInfo()
+	ver, err := CapsVer(capsHash, info)
+	if err != nil && Debug {
+		// We made a mess of our own disco info.
+		log.Printf("Caps: %v", err)
+	}
+	return info, ver
+}
+
+// Add our capabilities to outgoing available presence, and make sure
+// we can answer the disco#info query it may prompt.
+func (ec *EntityCaps) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for st := range in {
+		p, ok := st.(*Presence)
+		if ok && PresenceType(p.Type) == PresenceAvailable &&
+			presenceCaps(p) == nil {
+			// The node describes the info this hash
+			// was computed from, even if our features
+			// change later.
+			info, ver := ec.localVer()
+			ec.client.Disco.SetNode(ec.node+"#"+ver,
+				func() *DiscoInfo { return info })
+			// The application may reuse its presence, so
+			// leave it alone.
+			cp := *p
+			cp.Nested = append(append([]interface{}(nil),
+				p.Nested...), &Caps{Hash: capsHash,
+				Node: ec.node, Ver: ver})
+			st = &cp
+		}
+		out <- st
+	}
+}
+
+// Note the capabilities in incoming presence, and find out what any
+// new ones mean.
+func (ec *EntityCaps) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for st := range in {
+		if p, ok := st.(*Presence); ok {
+			ec.notePresence(p)
+		}
+		out <- st
+	}
+}
+
+func (ec *EntityCaps) notePresence(p *Presence) {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	switch PresenceType(p.Type) {
+	case PresenceAvailable:
+	case PresenceUnavailable, PresenceError:
+		delete(ec.jids, p.From)
+		return
+	default:
+		return
+	}
+	c := presenceCaps(p)
+	// Legacy caps, without a hash, can't be verified, so we don't
+	// use them.
+	if c == nil || c.Hash == "" || capsHashes[c.Hash] == nil {
+		delete(ec.jids, p.From)
+		return
+	}
+	ec.jids[p.From] = *c
+	key := capsKey{c.Hash, c.Ver}
+	if ec.pending[key] {
+		return
+	}
+	if info, _ := ec.cache.Get(c.Hash, c.Ver); info != nil {
+		return
+	}
+	ec.pending[key] = true
+	go ec.lookup(p.From, *c)
+}
+
+// Ask an entity what its capabilities hash means, and remember the
+// answer if it checks out.
+func (ec *EntityCaps) lookup(jid JID, c Caps) {
+	defer func() {
+		ec.lock.Lock()
+		delete(ec.pending, capsKey{c.Hash, c.Ver})
+		ec.lock.Unlock()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		capsQueryTimeout)
+	defer cancel()
+	info, err := ec.client.Disco.QueryInfo(ctx, jid, c.Node+"#"+c.Ver)
+	if err != nil {
+		if Debug {
+			log.Printf("Caps query to %s: %v", jid, err)
+		}
+		return
+	}
+	ver, err := CapsVer(c.Hash, info)
+	if err == nil && ver != c.Ver {
+		// Somebody's lying to us, or confused.
+		err = fmt.Errorf("hash is %s, not %s", ver, c.Ver)
+	}
+	if err != nil {
+		if Debug {
+			log.Printf("Caps from %s don't verify: %v", jid,
+				err)
+		}
+		return
+	}
+	info.Node = ""
+	err = ec.cache.Put(c.Hash, c.Ver, info)
+	if err != nil && Debug {
+		log.Printf("Caps cache: %v", err)
+	}
+}
+
+// Returns the capabilities of the entity at a full JID, or nil if
+// they aren't known (yet).
+func (ec *EntityCaps) Info(jid JID) *DiscoInfo {
+	ec.lock.Lock()
+	c, ok := ec.jids[jid]
+	ec.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	info, err := ec.cache.Get(c.Hash, c.Ver)
+	if err != nil && Debug {
+		log.Printf("Caps cache: %v", err)
+	}
+	return info
+}
+
+// Does the entity at a full JID support a feature? False if we don't
+// know.
+func (ec *EntityCaps) Supports(jid JID, feature string) bool {
+	info := ec.Info(jid)
+	return info != nil && info.HasFeature(feature)
+}
+
+func presenceCaps(p *Presence) *Caps {
+	for _, ele := range p.Nested {
+		if c, ok := ele.(*Caps); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+func (c *MemoryCapsCache) Get(hash, ver string) (*DiscoInfo, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.m[capsKey{hash, ver}], nil
+}
+
+func (c *MemoryCapsCache) Put(hash, ver string, info *DiscoInfo) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.m == nil {
+		c.m = make(map[capsKey]*DiscoInfo)
+	}
+	c.m[capsKey{hash, ver}] = info
+	return nil
+}
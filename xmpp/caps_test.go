@@ -0,0 +1,202 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+// The simple example from XEP-0115, section 5.2.
+func exodusInfo() *DiscoInfo {
+	return &DiscoInfo{
+		Identities: []DiscoIdentity{{Category: "client", Type: "pc",
+			Name: "Exodus 0.9.1"}},
+		Features: []DiscoFeature{{Var: NsCaps}, {Var: NsDiscoInfo},
+			{Var: NsDiscoItems},
+			{Var: "http://jabber.org/protocol/muc"}},
+	}
+}
+
+func TestCapsVer(t *testing.T) {
+	ver, err := CapsVer("sha-1", exodusInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, "QgayPKawpkPSDYmwT/WM94uAlu0=", ver)
+
+	// The complex example from section 5.3.
+	form := NewForm(FormTypeResult, "urn:xmpp:dataforms:softwareinfo")
+	form.Set("ip_version", "ipv6", "ipv4")
+	form.Set("os", "Mac")
+	form.Set("os_version", "10.5.1")
+	form.Set("software", "Psi")
+	form.Set("software_version", "0.11")
+	info := &DiscoInfo{
+		Identities: []DiscoIdentity{
+			{Category: "client", Type: "pc", Lang: "en",
+				Name: "Psi 0.11"},
+			{Category: "client", Type: "pc", Lang: "el",
+				Name: "Ψ 0.11"}},
+		Features: []DiscoFeature{{Var: NsDiscoItems},
+			{Var: NsDiscoInfo}, {Var: NsCaps},
+			{Var: "http://jabber.org/protocol/muc"}},
+		Forms: []Form{*form},
+	}
+	ver, err = CapsVer("sha-1", info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, "q07IKJEyjvHSyhy//CH0CxmKi8w=", ver)
+
+	// Some things aren't allowed.
+	info.Forms = append(info.Forms, *form)
+	if _, err := CapsVer("sha-1", info); err == nil {
+		t.Error("no error for repeated form")
+	}
+	info = exodusInfo()
+	info.Features = append(info.Features, DiscoFeature{Var: NsCaps})
+	if _, err := CapsVer("sha-1", info); err == nil {
+		t.Error("no error for repeated feature")
+	}
+	if _, err := CapsVer("md5", exodusInfo()); err == nil {
+		t.Error("no error for unknown hash")
+	}
+}
+
+func TestEntityCapsSend(t *testing.T) {
+	cl := &Client{Jid: "me@example.com/res"}
+	cl.Disco = newDisco()
+	cl.Disco.Init(cl)
+	ec := NewEntityCaps("https://example.com/client", nil)
+	ec.Init(cl)
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	go ec.sendFilter(in, out)
+	defer close(in)
+
+	pr := NewAvailablePresence(ShowAway, "", 0)
+	in <- pr
+	p := (<-out).(*Presence)
+	if len(pr.Nested) != 0 {
+		t.Error("original presence changed")
+	}
+	c := presenceCaps(p)
+	if c == nil {
+		t.Fatal("no caps")
+	}
+	ver, _ := CapsVer("sha-1", cl.Disco.LocalInfo())
+	assertEquals(t, ver, c.Ver)
+	assertEquals(t, "sha-1", c.Hash)
+
+	// We can say what the hash means.
+	h := cl.iqHandler("get", xml.Name{Space: NsDiscoInfo, Local: "query"})
+	req := &Iq{Header: Header{From: "you@example.com/a", Id: "1",
+		Type: "get"}}
+	req.Nested = []interface{}{&DiscoInfo{Node: c.Node + "#" + c.Ver}}
+	info := discoInfo(h(req))
+	if info == nil || !info.HasFeature(NsCaps) {
+		t.Fatalf("info %v", info)
+	}
+	assertEquals(t, c.Node+"#"+c.Ver, info.Node)
+
+	// What the hash means doesn't change with our features.
+	cl.Disco.AddFeature("urn:example:new")
+	info = discoInfo(h(req))
+	if info == nil || info.HasFeature("urn:example:new") {
+		t.Fatalf("info %v", info)
+	}
+	info.Node = ""
+	if v, _ := CapsVer("sha-1", info); v != c.Ver {
+		t.Errorf("node answers with hash %s", v)
+	}
+
+	// Unavailable presence doesn't get caps.
+	in <- &Presence{Header: Header{Type: "unavailable"}}
+	if p := (<-out).(*Presence); presenceCaps(p) != nil {
+		t.Error("caps on unavailable presence")
+	}
+}
+
+func capsPresence(from JID, ver string) *Presence {
+	p := &Presence{Header: Header{From: from}}
+	p.Nested = []interface{}{&Caps{Hash: "sha-1",
+		Node: "http://code.google.com/p/exodus", Ver: ver}}
+	return p
+}
+
+func TestEntityCapsRecv(t *testing.T) {
+	cl, recv, sent := newTestClient()
+	defer close(recv)
+	cl.Disco = newDisco()
+	cl.Disco.Init(cl)
+	ec := NewEntityCaps("https://example.com/client", nil)
+	ec.Init(cl)
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	go ec.recvFilter(in, out)
+	defer close(in)
+	const muc = "http://jabber.org/protocol/muc"
+
+	// A hash that doesn't match what we're told isn't believed.
+	in <- capsPresence("liar@example.com/a", "bogus")
+	<-out
+	iq := (<-sent).(*Iq)
+	reply := iq.Reply(exodusInfo())
+	reply.From = iq.To
+	recv <- reply
+
+	in <- capsPresence("you@example.com/a", "QgayPKawpkPSDYmwT/WM94uAlu0=")
+	<-out
+	iq = (<-sent).(*Iq)
+	assertEquals(t, "you@example.com/a", string(iq.To))
+	q := discoInfo(iq)
+	assertEquals(t, "http://code.google.com/p/exodus#"+
+		"QgayPKawpkPSDYmwT/WM94uAlu0=", q.Node)
+	reply = iq.Reply(exodusInfo())
+	reply.From = iq.To
+	recv <- reply
+	deadline := time.Now().Add(time.Second)
+	for !ec.Supports("you@example.com/a", muc) {
+		if time.Now().After(deadline) {
+			t.Fatal("caps never verified")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Once the hash is known, there's no need to ask.
+	in <- capsPresence("them@example.com/b", "QgayPKawpkPSDYmwT/WM94uAlu0=")
+	<-out
+	if !ec.Supports("them@example.com/b", muc) {
+		t.Error("them doesn't support muc")
+	}
+	select {
+	case st := <-sent:
+		t.Errorf("sent %v", st)
+	default:
+	}
+	if ec.Supports("liar@example.com/a", muc) {
+		t.Error("believed a liar")
+	}
+
+	// The same string from another hash function means something
+	// else.
+	p := capsPresence("other@example.com/c", "QgayPKawpkPSDYmwT/WM94uAlu0=")
+	presenceCaps(p).Hash = "sha-256"
+	in <- p
+	<-out
+	iq = (<-sent).(*Iq)
+	assertEquals(t, "other@example.com/c", string(iq.To))
+	reply = iq.Reply(exodusInfo())
+	reply.From = iq.To
+	recv <- reply
+	if ec.Supports("other@example.com/c", muc) {
+		t.Error("sha-256 caps believed")
+	}
+
+	in <- &Presence{Header: Header{From: "you@example.com/a",
+		Type: "unavailable"}}
+	<-out
+	if ec.Info("you@example.com/a") != nil {
+		t.Error("caps still known after unavailable")
+	}
+}
@@ -0,0 +1,292 @@
+package xmpp
+
+// This file contains support for service discovery, XEP-0030.
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+const (
+	NsDiscoInfo  = "http://jabber.org/protocol/disco#info"
+	NsDiscoItems = "http://jabber.org/protocol/disco#items"
+)
+
+// A disco#info query or result.
+type DiscoInfo struct {
+	XMLName    xml.Name        `xml:"http://jabber.org/protocol/disco#info query"`
+	Node       string          `xml:"node,attr,omitempty"`
+	Identities []DiscoIdentity `xml:"identity"`
+	Features   []DiscoFeature  `xml:"feature"`
+	// Extended information. XEP-0128.
+	Forms []Form `xml:"jabber:x:data x"`
+}
+
+// What kind of entity something is. See the registry at
+// https://xmpp.org/registrar/disco-categories.html.
+type DiscoIdentity struct {
+	Category string `xml:"category,attr"`
+	Type     string `xml:"type,attr"`
+	Name     string `xml:"name,attr,omitempty"`
+	Lang     string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+}
+
+// A protocol an entity supports, usually named by its namespace.
+type DiscoFeature struct {
+	Var string `xml:"var,attr"`
+}
+
+// A disco#items query or result.
+type DiscoItems struct {
+	XMLName xml.Name    `xml:"http://jabber.org/protocol/disco#items query"`
+	Node    string      `xml:"node,attr,omitempty"`
+	Items   []DiscoItem `xml:"item"`
+}
+
+// An entity associated with the one queried, such as a service on a
+// server.
+type DiscoItem struct {
+	Jid  JID    `xml:"jid,attr"`
+	Node string `xml:"node,attr,omitempty"`
+	Name string `xml:"name,attr,omitempty"`
+}
+
+// Disco answers service discovery queries about this client, and
+// queries other entities. Extensions which implement a protocol
+// should declare it here, with AddFeature, from their Init function.
+type Disco struct {
+	Extension
+	lock       sync.Mutex
+	identities []DiscoIdentity
+	features   map[string]bool
+	items      []DiscoItem
+	nodes      map[string]func() *DiscoInfo
+	client     *Client
+}
+
+func newDisco() *Disco {
+	d := &Disco{}
+	d.identities = []DiscoIdentity{{Category: "client", Type: "pc"}}
+	d.features = map[string]bool{NsDiscoInfo: true, NsDiscoItems: true}
+	d.nodes = make(map[string]func() *DiscoInfo)
+	d.StanzaTypes = make(map[xml.Name]reflect.Type)
+	infoName := xml.Name{Space: NsDiscoInfo, Local: "query"}
+	itemsName := xml.Name{Space: NsDiscoItems, Local: "query"}
+	d.StanzaTypes[infoName] = reflect.TypeOf(DiscoInfo{})
+	d.StanzaTypes[itemsName] = reflect.TypeOf(DiscoItems{})
+	d.Init = func(cl *Client) {
+		d.client = cl
+		cl.HandleIq("get", infoName, d.handleInfo)
+		cl.HandleIq("get", itemsName, d.handleItems)
+	}
+	return d
+}
+
+// Replace the identities we report. The default is a single identity
+// of category "client" and type "pc".
+func (d *Disco) SetIdentities(ids ...DiscoIdentity) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.identities = append([]DiscoIdentity(nil), ids...)
+}
+
+// Declare that we support some features.
+func (d *Disco) AddFeature(vars ...string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, v := range vars {
+		d.features[v] = true
+	}
+}
+
+// Stop declaring some features.
+func (d *Disco) RemoveFeature(vars ...string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, v := range vars {
+		delete(d.features, v)
+	}
+}
+
+// Replace the items we report in answer to disco#items queries.
+func (d *Disco) SetItems(items ...DiscoItem) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.items = append([]DiscoItem(nil), items...)
+}
+
+// Answer disco#info queries about a node with whatever info returns.
+// A nil info removes the node. If info returns nil, the node is
+// reported as not found.
+func (d *Disco) SetNode(node string, info func() *DiscoInfo) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if info == nil {
+		delete(d.nodes, node)
+	} else {
+		d.nodes[node] = info
+	}
+}
+
+// Returns what we tell others about ourselves, with the features in
+// order.
+func (d *Disco) LocalInfo() *DiscoInfo {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	info := &DiscoInfo{}
+	info.Identities = append(info.Identities, d.identities...)
+	vars := make([]string, 0, len(d.features))
+	for v := range d.features {
+		vars = append(vars, v)
+	}
+	sort.Strings(vars)
+	for _, v := range vars {
+		info.Features = append(info.Features, DiscoFeature{Var: v})
+	}
+	return info
+}
+
+func (d *Disco) handleInfo(iq *Iq) *Iq {
+	q := discoInfo(iq)
+	if q == nil {
+		return iq.ErrorReply(NewError(ErrorBadRequest, ""))
+	}
+	if q.Node == "" {
+		return iq.Reply(d.LocalInfo())
+	}
+	d.lock.Lock()
+	f := d.nodes[q.Node]
+	d.lock.Unlock()
+	if f == nil {
+		return iq.ErrorReply(NewError(ErrorItemNotFound, ""))
+	}
+	info := f()
+	if info == nil {
+		return iq.ErrorReply(NewError(ErrorItemNotFound, ""))
+	}
+	// The provider may hand out the same info every time.
+	reply := *info
+	reply.Node = q.Node
+	return iq.Reply(&reply)
+}
+
+func (d *Disco) handleItems(iq *Iq) *Iq {
+	q := discoItems(iq)
+	if q == nil {
+		return iq.ErrorReply(NewError(ErrorBadRequest, ""))
+	}
+	if q.Node != "" {
+		return iq.ErrorReply(NewError(ErrorItemNotFound, ""))
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	res := &DiscoItems{}
+	res.Items = append(res.Items, d.items...)
+	return iq.Reply(res)
+}
+
+// Ask an entity about its identities and features. Node is usually
+// "".
+func (d *Disco) QueryInfo(ctx context.Context, to JID,
+	node string) (*DiscoInfo, error) {
+
+	reply, err := d.client.SendIq(ctx, NewIq(IqGet, to,
+		&DiscoInfo{Node: node}))
+	if err != nil {
+		return nil, err
+	}
+	info := discoInfo(reply)
+	if info == nil {
+		return nil, fmt.Errorf("no disco#info in reply from %s", to)
+	}
+	return info, nil
+}
+
+// Ask an entity which items it has, such as the services on a
+// server. Node is usually "".
+func (d *Disco) QueryItems(ctx context.Context, to JID,
+	node string) (*DiscoItems, error) {
+
+	reply, err := d.client.SendIq(ctx, NewIq(IqGet, to,
+		&DiscoItems{Node: node}))
+	if err != nil {
+		return nil, err
+	}
+	items := discoItems(reply)
+	if items == nil {
+		return nil, fmt.Errorf("no disco#items in reply from %s", to)
+	}
+	return items, nil
+}
+
+// Find the services on our server which support a feature, such as
+// multi-user chat or publish-subscribe. Services which don't answer
+// are skipped.
+func (d *Disco) FindServices(ctx context.Context,
+	feature string) ([]JID, error) {
+
+	server := JID(d.client.Jid.Domain())
+	items, err := d.QueryItems(ctx, server, "")
+	if err != nil {
+		return nil, err
+	}
+	var found []JID
+	for _, item := range items.Items {
+		if item.Node != "" {
+			continue
+		}
+		info, err := d.QueryInfo(ctx, item.Jid, "")
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		if info.HasFeature(feature) {
+			found = append(found, item.Jid)
+		}
+	}
+	return found, nil
+}
+
+// Does the entity support the feature?
+func (info *DiscoInfo) HasFeature(v string) bool {
+	for _, f := range info.Features {
+		if f.Var == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Does the entity have an identity of the given category and type?
+func (info *DiscoInfo) HasIdentity(category, typ string) bool {
+	for _, id := range info.Identities {
+		if id.Category == category && id.Type == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func discoInfo(iq *Iq) *DiscoInfo {
+	for _, ele := range iq.Nested {
+		if q, ok := ele.(*DiscoInfo); ok {
+			return q
+		}
+	}
+	return nil
+}
+
+func discoItems(iq *Iq) *DiscoItems {
+	for _, ele := range iq.Nested {
+		if q, ok := ele.(*DiscoItems); ok {
+			return q
+		}
+	}
+	return nil
+}
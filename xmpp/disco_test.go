@@ -0,0 +1,132 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"testing"
+)
+
+func TestDiscoInfoUnmarshal(t *testing.T) {
+	str := `<iq type="result" id="1"><query xmlns="` + NsDiscoInfo +
+		`"><identity category="conference" type="text"` +
+		` name="Chat rooms"/><feature var="` + NsDiscoInfo + `"/>` +
+		`<feature var="http://jabber.org/protocol/muc"/></query></iq>`
+	iq := &Iq{}
+	if err := xml.Unmarshal([]byte(str), iq); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseExtended(&iq.Header, newDisco().StanzaTypes); err != nil {
+		t.Fatal(err)
+	}
+	info := discoInfo(iq)
+	if info == nil {
+		t.Fatalf("no info in %v", iq.Nested)
+	}
+	if !info.HasIdentity("conference", "text") ||
+		!info.HasFeature("http://jabber.org/protocol/muc") ||
+		info.HasFeature("urn:example") {
+		t.Errorf("info %v", info)
+	}
+	assertEquals(t, "Chat rooms", info.Identities[0].Name)
+}
+
+func TestDiscoResponder(t *testing.T) {
+	cl := &Client{Jid: "me@example.com/res"}
+	d := newDisco()
+	d.Init(cl)
+	d.AddFeature("urn:example:b", "urn:example:a")
+	d.RemoveFeature("urn:example:b")
+
+	h := cl.iqHandler("get", xml.Name{Space: NsDiscoInfo, Local: "query"})
+	req := &Iq{Header: Header{From: "you@example.com/a", Id: "1",
+		Type: "get"}}
+	req.Nested = []interface{}{&DiscoInfo{}}
+	reply := h(req)
+	exp := `<iq to="you@example.com/a" id="1" type="result">` +
+		`<query xmlns="` + NsDiscoInfo + `">` +
+		`<identity category="client" type="pc"></identity>` +
+		`<feature var="` + NsDiscoInfo + `"></feature>` +
+		`<feature var="` + NsDiscoItems + `"></feature>` +
+		`<feature var="urn:example:a"></feature></query></iq>`
+	assertMarshal(t, exp, reply)
+
+	req.Nested = []interface{}{&DiscoInfo{Node: "nonesuch"}}
+	if reply = h(req); !errors.Is(reply.Error, ErrorItemNotFound) {
+		t.Errorf("reply %v", reply)
+	}
+
+	shared := &DiscoInfo{Features: []DiscoFeature{{Var: "urn:example:c"}}}
+	d.SetNode("urn:example:node", func() *DiscoInfo { return shared })
+	req.Nested = []interface{}{&DiscoInfo{Node: "urn:example:node"}}
+	reply = h(req)
+	if info := discoInfo(reply); info == nil ||
+		info.Node != "urn:example:node" || len(info.Features) != 1 {
+		t.Errorf("reply %v", reply)
+	}
+	if shared.Node != "" {
+		t.Errorf("provider's info changed: %v", shared)
+	}
+	d.SetNode("urn:example:gone", func() *DiscoInfo { return nil })
+	req.Nested = []interface{}{&DiscoInfo{Node: "urn:example:gone"}}
+	if reply = h(req); !errors.Is(reply.Error, ErrorItemNotFound) {
+		t.Errorf("reply %v", reply)
+	}
+
+	d.SetItems(DiscoItem{Jid: "me@example.com/res", Node: "stuff"})
+	h = cl.iqHandler("get", xml.Name{Space: NsDiscoItems, Local: "query"})
+	req.Nested = []interface{}{&DiscoItems{}}
+	reply = h(req)
+	items := discoItems(reply)
+	if items == nil || len(items.Items) != 1 ||
+		items.Items[0].Node != "stuff" {
+		t.Errorf("reply %v", reply)
+	}
+}
+
+func TestFindServices(t *testing.T) {
+	cl, recv, sent := newTestClient()
+	defer close(recv)
+	d := newDisco()
+	d.Init(cl)
+	const pubsub = "urn:example:pubsub"
+
+	type result struct {
+		jids []JID
+		err  error
+	}
+	ch := make(chan result)
+	go func() {
+		jids, err := d.FindServices(context.Background(), pubsub)
+		ch <- result{jids, err}
+	}()
+	iq := (<-sent).(*Iq)
+	assertEquals(t, "example.com", string(iq.To))
+	reply := iq.Reply(&DiscoItems{Items: []DiscoItem{
+		{Jid: "conference.example.com"}, {Jid: "pubsub.example.com"},
+		{Jid: "gone.example.com"}}})
+	reply.From = iq.To
+	recv <- reply
+
+	features := map[JID]string{"conference.example.com": "urn:example:muc",
+		"pubsub.example.com": pubsub}
+	for i := 0; i < 3; i++ {
+		iq = (<-sent).(*Iq)
+		if iq.To == "gone.example.com" {
+			reply = iq.ErrorReply(NewError(
+				ErrorRemoteServerNotFound, ""))
+		} else {
+			reply = iq.Reply(&DiscoInfo{Features: []DiscoFeature{
+				{Var: features[iq.To]}}})
+		}
+		reply.From = iq.To
+		recv <- reply
+	}
+	r := <-ch
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if len(r.jids) != 1 || r.jids[0] != "pubsub.example.com" {
+		t.Errorf("found %v", r.jids)
+	}
+}
@@ -0,0 +1,107 @@
+package xmpp
+
+// This file contains support for data forms, XEP-0004.
+
+import (
+	"encoding/xml"
+)
+
+const NsData = "jabber:x:data"
+
+// Values for Form.Type.
+const (
+	FormTypeForm   = "form"
+	FormTypeSubmit = "submit"
+	FormTypeCancel = "cancel"
+	FormTypeResult = "result"
+)
+
+// The field which names the kind of form it is. XEP-0068.
+const formTypeVar = "FORM_TYPE"
+
+// A data form, used for configuring things and for structured
+// results.
+type Form struct {
+	XMLName      xml.Name    `xml:"jabber:x:data x"`
+	Type         string      `xml:"type,attr"`
+	Title        string      `xml:"title,omitempty"`
+	Instructions []string    `xml:"instructions"`
+	Fields       []FormField `xml:"field"`
+}
+
+type FormField struct {
+	Var string `xml:"var,attr,omitempty"`
+	// "boolean", "fixed", "hidden", "jid-multi", "jid-single",
+	// "list-multi", "list-single", "text-multi", "text-private",
+	// or "text-single". The default is "text-single".
+	Type     string       `xml:"type,attr,omitempty"`
+	Label    string       `xml:"label,attr,omitempty"`
+	Desc     string       `xml:"desc,omitempty"`
+	Required *struct{}    `xml:"required"`
+	Values   []string     `xml:"value"`
+	Options  []FormOption `xml:"option"`
+}
+
+// One of the choices for a list field.
+type FormOption struct {
+	Label string `xml:"label,attr,omitempty"`
+	Value string `xml:"value"`
+}
+
+// Creates a form of the given type, with a hidden FORM_TYPE field if
+// formType isn't empty.
+func NewForm(typ, formType string) *Form {
+	f := &Form{Type: typ}
+	if formType != "" {
+		f.Fields = append(f.Fields, FormField{Var: formTypeVar,
+			Type: "hidden", Values: []string{formType}})
+	}
+	return f
+}
+
+// Returns the field with the given name, or nil.
+func (f *Form) Field(v string) *FormField {
+	for i := range f.Fields {
+		if f.Fields[i].Var == v {
+			return &f.Fields[i]
+		}
+	}
+	return nil
+}
+
+// Returns the first value of a field, or "" if there isn't one.
+func (f *Form) Value(v string) string {
+	fld := f.Field(v)
+	if fld == nil || len(fld.Values) == 0 {
+		return ""
+	}
+	return fld.Values[0]
+}
+
+// Sets the values of a field, adding it if necessary.
+func (f *Form) Set(v string, values ...string) {
+	if fld := f.Field(v); fld != nil {
+		fld.Values = values
+		return
+	}
+	f.Fields = append(f.Fields, FormField{Var: v, Values: values})
+}
+
+// Returns the value of the form's FORM_TYPE field.
+func (f *Form) FormType() string {
+	return f.Value(formTypeVar)
+}
+
+// Returns a form suitable for submitting in answer to this one, with
+// each field's current value.
+func (f *Form) Submit() *Form {
+	sub := &Form{Type: FormTypeSubmit}
+	for _, fld := range f.Fields {
+		if fld.Var == "" || fld.Type == "fixed" {
+			continue
+		}
+		sub.Fields = append(sub.Fields, FormField{Var: fld.Var,
+			Values: fld.Values})
+	}
+	return sub
+}
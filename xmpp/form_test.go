@@ -0,0 +1,39 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestFormSubmit(t *testing.T) {
+	str := `<x xmlns="jabber:x:data" type="form"><title>Config</title>` +
+		`<field var="FORM_TYPE" type="hidden"><value>urn:example</value>` +
+		`</field><field type="fixed"><value>Section</value></field>` +
+		`<field var="name" type="text-single" label="Name"><required/>` +
+		`</field><field var="color" type="list-single">` +
+		`<value>red</value><option label="Red"><value>red</value>` +
+		`</option><option><value>blue</value></option></field></x>`
+	var form Form
+	if err := xml.Unmarshal([]byte(str), &form); err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, "urn:example", form.FormType())
+	assertEquals(t, "red", form.Value("color"))
+	if fld := form.Field("name"); fld == nil || fld.Required == nil {
+		t.Errorf("name field %v", fld)
+	}
+	if opts := form.Field("color").Options; len(opts) != 2 ||
+		opts[1].Value != "blue" {
+		t.Errorf("options %v", opts)
+	}
+
+	sub := form.Submit()
+	sub.Set("name", "Bob")
+	sub.Set("color", "blue")
+	exp := `<x xmlns="jabber:x:data" type="submit">` +
+		`<field var="FORM_TYPE"><value>urn:example</value></field>` +
+		`<field var="name"><value>Bob</value></field>` +
+		`<field var="color"><value>blue</value></field></x>`
+	assertMarshal(t, exp, sub)
+	assertEquals(t, "red", form.Value("color"))
+}
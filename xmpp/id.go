@@ -3,27 +3,31 @@ package xmpp
 // Code to generate unique IDs for outgoing messages.
 
 import (
+	"crypto/rand"
 	"fmt"
 )
 
-var id <-chan string
-
-func init() {
-	// Start the unique id generator.
-	idCh := make(chan string)
-	id = idCh
-	go func(ch chan<- string) {
-		id := int64(1)
-		for {
-			str := fmt.Sprintf("id_%d", id)
-			ch <- str
-			id++
-		}
-	}(idCh)
-}
-
 // This function may be used as a convenient way to generate a unique
-// id for an outgoing iq, message, or presence stanza.
+// id for an outgoing iq, message, or presence stanza. The ids are
+// random (version 4) UUIDs, so they can't be guessed by other
+// entities. Prefer Client.NextId, which honors the IdGenerator in
+// the client's options.
 func NextId() string {
-	return <-id
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("NextId: %v", err))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8],
+		b[8:10], b[10:])
+}
+
+// Returns a new id for a stanza sent by this client, from the
+// IdGenerator in its options if there is one.
+func (cl *Client) NextId() string {
+	if cl.idGenerator != nil {
+		return cl.idGenerator()
+	}
+	return NextId()
 }
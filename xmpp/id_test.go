@@ -0,0 +1,39 @@
+package xmpp
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+)
+
+func TestNextId(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-` +
+		`[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := NextId()
+		if !uuid.MatchString(id) {
+			t.Fatalf("not a UUID: %s", id)
+		}
+		if seen[id] {
+			t.Fatalf("duplicate id %s", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestClientNextId(t *testing.T) {
+	n := 0
+	cl := &Client{idGenerator: func() string {
+		n++
+		return fmt.Sprintf("test_%d", n)
+	}}
+	assertEquals(t, "test_1", cl.NextId())
+	assertEquals(t, "test_2", cl.NextId())
+
+	// Clients don't share a sequence.
+	other := &Client{}
+	if id := other.NextId(); id == "test_3" {
+		t.Errorf("got %s", id)
+	}
+}
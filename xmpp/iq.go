@@ -0,0 +1,268 @@
+package xmpp
+
+// This file contains support for iq request/response exchanges.
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errShutdown = errors.New("client shut down")
+
+// An IqHandler answers an incoming iq request of type "get" or "set".
+// It returns the reply to send, usually made with Iq.Reply or
+// Iq.ErrorReply. If it returns nil, it's responsible for replying
+// some other way. Each request is handled in its own goroutine, unless
+// the handler was registered with HandleIqInOrder.
+type IqHandler func(iq *Iq) *Iq
+
+type iqRoute struct {
+	typ  string
+	name xml.Name
+}
+
+// Send an iq request and wait for its reply. If the iq has no id, one
+// is assigned. Only a reply with the same id from the entity the
+// request was sent to is accepted. A reply of type "error" is
+// returned along with its *Error. If ctx is done or the client shuts
+// down before the reply arrives, the request is forgotten and an
+// error is returned.
+func (cl *Client) SendIq(ctx context.Context, iq *Iq) (*Iq, error) {
+	if iq.Id == "" {
+		iq.Id = cl.NextId()
+	}
+	ch := make(chan Stanza, 1)
+	h := &callback{id: iq.Id, reply: true, to: iq.To,
+		f: func(st Stanza) { ch <- st }}
+	select {
+	case cl.handlers <- h:
+	case <-cl.done:
+		return nil, cl.getError(errShutdown)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	err := cl.send(ctx, iq)
+	if err == nil {
+		select {
+		case st := <-ch:
+			return iqResult(st)
+		case <-cl.done:
+			err = cl.getError(errShutdown)
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	// Forget the callback, so it doesn't hang around forever.
+	select {
+	case cl.handlers <- &callback{id: iq.Id}:
+	case <-cl.done:
+	}
+	return nil, err
+}
+
+// Interpret the stanza we received in reply to an iq request.
+func iqResult(st Stanza) (*Iq, error) {
+	reply, ok := st.(*Iq)
+	if !ok {
+		return nil, fmt.Errorf("non-iq reply %#v", st)
+	}
+	switch reply.Type {
+	case "result":
+		return reply, nil
+	case "error":
+		if reply.Error == nil {
+			return reply, NewError(ErrorUndefinedCondition, "")
+		}
+		return reply, reply.Error
+	}
+	return nil, fmt.Errorf("bad iq reply type %q", reply.Type)
+}
+
+// Send a stanza on Client.Send, returning once it's been accepted for
+// sending. Unlike sending on the channel directly, an invalid stanza
+// is reported here with Validate's error rather than dropped. If ctx
+// is done or the client shuts down first, the stanza isn't sent.
+func (cl *Client) SendStanza(ctx context.Context, st Stanza) error {
+	return cl.send(ctx, st)
+}
+
+// Send a stanza through the normal outgoing path, giving up if ctx is
+// done or the client shuts down. Invalid stanzas are refused.
+// Client.Send isn't closed until the stream has ended and no send is
+// in progress, so this can't send on a closed channel.
+func (cl *Client) send(ctx context.Context, st Stanza) error {
+	if err := Validate(st); err != nil {
+		return err
+	}
+	cl.sendLock.RLock()
+	defer cl.sendLock.RUnlock()
+	select {
+	case <-cl.done:
+		return cl.getError(errShutdown)
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	select {
+	case cl.Send <- st:
+		return nil
+	case <-cl.done:
+		return cl.getError(errShutdown)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Could a stanza from "from" be the reply to a request we sent to
+// "to"? Our server answers requests with no to address, and those
+// addressed to our own bare JID, on our behalf; those replies may
+// come from our bare or full JID, from our server, or have no from
+// at all. The server stamps a from on everything else it delivers to
+// us, so an empty from can only be the server itself. RFC 6120,
+// section 10.3.3.
+func (cl *Client) isReplyFrom(to, from JID) bool {
+	server := JID(cl.Jid.Domain())
+	if to == "" || sameJid(to, cl.Jid.Bare()) {
+		return from == "" || sameJid(from, cl.Jid.Bare()) ||
+			sameJid(from, cl.Jid) || sameJid(from, server)
+	}
+	if from == "" {
+		return sameJid(to, server)
+	}
+	return sameJid(from, to)
+}
+
+// Compare two JIDs. Resources are case-sensitive; the rest isn't.
+func sameJid(a, b JID) bool {
+	return strings.EqualFold(string(a.Bare()), string(b.Bare())) &&
+		a.Resource() == b.Resource()
+}
+
+// Register a handler for incoming iq requests of the given type
+// ("get" or "set") whose child element has the given name. This
+// replaces any handler previously registered for the same type and
+// name; a nil handler removes it. Requests which have no handler are
+// answered with service-unavailable. Either way, get and set iqs are
+// not delivered to Client.Recv.
+func (cl *Client) HandleIq(typ string, name xml.Name, h IqHandler) {
+	cl.handleIq(iqRoute{typ: typ, name: name}, h, false)
+}
+
+// Like HandleIq, but the handler is given one request at a time, in
+// the order they arrive. This is for requests which must be applied
+// in order, such as roster pushes.
+func (cl *Client) HandleIqInOrder(typ string, name xml.Name,
+	h IqHandler) {
+
+	cl.handleIq(iqRoute{typ: typ, name: name}, h, true)
+}
+
+func (cl *Client) handleIq(route iqRoute, h IqHandler, ordered bool) {
+	cl.iqLock.Lock()
+	defer cl.iqLock.Unlock()
+	if cl.iqHandlers == nil {
+		cl.iqHandlers = make(map[iqRoute]IqHandler)
+		cl.iqOrdered = make(map[iqRoute]bool)
+	}
+	if h == nil {
+		delete(cl.iqHandlers, route)
+	} else {
+		cl.iqHandlers[route] = h
+	}
+	if h != nil && ordered {
+		cl.iqOrdered[route] = true
+	} else {
+		delete(cl.iqOrdered, route)
+	}
+}
+
+func (cl *Client) iqHandler(typ string, name xml.Name) IqHandler {
+	cl.iqLock.Lock()
+	defer cl.iqLock.Unlock()
+	return cl.iqHandlers[iqRoute{typ: typ, name: name}]
+}
+
+func (cl *Client) iqInOrder(route iqRoute) bool {
+	cl.iqLock.Lock()
+	defer cl.iqLock.Unlock()
+	return cl.iqOrdered[route]
+}
+
+// A filter which takes incoming get and set iqs out of the stream
+// and passes them to their handlers. Every request gets an answer,
+// as RFC 6120, section 8.2.3 requires.
+func (cl *Client) routeIq(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	// Requests waiting to be handled in order, by route.
+	ordered := make(map[iqRoute]chan<- *Iq)
+	defer func() {
+		for _, q := range ordered {
+			close(q)
+		}
+	}()
+	for st := range in {
+		iq, ok := st.(*Iq)
+		if !ok || (iq.Type != "get" && iq.Type != "set") {
+			out <- st
+			continue
+		}
+		route := iqRoute{typ: iq.Type, name: iqChild(iq)}
+		if !cl.iqInOrder(route) {
+			go cl.answerIq(iq, cl.iqHandler(route.typ, route.name))
+			continue
+		}
+		q := ordered[route]
+		if q == nil {
+			qin := make(chan *Iq)
+			qout := make(chan *Iq)
+			go queue(qin, qout, nil)
+			go func() {
+				for iq := range qout {
+					cl.answerIq(iq, cl.iqHandler(route.typ,
+						route.name))
+				}
+			}()
+			ordered[route] = qin
+			q = qin
+		}
+		q <- iq
+	}
+}
+
+// Answer a request with its handler, or with service-unavailable if
+// it has none.
+func (cl *Client) answerIq(iq *Iq, h IqHandler) {
+	var reply *Iq
+	if h == nil {
+		reply = iq.ErrorReply(NewError(ErrorServiceUnavailable, ""))
+	} else {
+		reply = h(iq)
+	}
+	if reply != nil {
+		cl.send(context.Background(), reply)
+	}
+}
+
+// Returns the name of the iq's payload element.
+func iqChild(iq *Iq) xml.Name {
+	return firstElement(iq.Innerxml)
+}
+
+// Returns the name of the first element in an XML fragment.
+func firstElement(frag string) xml.Name {
+	dec := xml.NewDecoder(strings.NewReader(frag))
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return xml.Name{}
+		}
+		if se, ok := t.(xml.StartElement); ok {
+			return se.Name
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Make a client with just enough plumbing to run recvStream. Feed it
+// XML structures on the returned channel; stanzas the client sends
+// appear on cl.Send's other end.
+func newTestClient() (*Client, chan<- interface{}, <-chan Stanza) {
+	cl := &Client{Jid: "me@example.com/res"}
+	cl.statmgr = newStatmgr(nil)
+	cl.handlers = make(chan *callback, 100)
+	cl.done = make(chan struct{})
+	send := make(chan Stanza, 10)
+	cl.Send = send
+	recvXml := make(chan interface{})
+	go cl.recvStream(recvXml, make(chan Stanza),
+		cl.statmgr.newListener())
+	return cl, recvXml, send
+}
+
+// A get request with a payload, so it passes validation.
+func testIq(to JID) *Iq {
+	return NewIq(IqGet, to, &Generic{XMLName: xml.Name{
+		Space: "urn:example", Local: "query"}})
+}
+
+type iqReply struct {
+	iq  *Iq
+	err error
+}
+
+func sendIqAsync(cl *Client, ctx context.Context, iq *Iq) <-chan iqReply {
+	ch := make(chan iqReply, 1)
+	go func() {
+		reply, err := cl.SendIq(ctx, iq)
+		ch <- iqReply{reply, err}
+	}()
+	return ch
+}
+
+func TestSendIq(t *testing.T) {
+	cl, recv, sent := newTestClient()
+	defer close(recv)
+
+	req := testIq("pubsub.example.com")
+	ch := sendIqAsync(cl, context.Background(), req)
+	out := (<-sent).(*Iq)
+	if out.Id == "" {
+		t.Fatal("no id assigned")
+	}
+
+	// A reply with the right id from the wrong entity is ignored.
+	recv <- &Iq{Header: Header{From: "evil.example.com", Id: out.Id,
+		Type: "result"}}
+	recv <- &Iq{Header: Header{From: "pubsub.example.com", Id: out.Id,
+		Type: "result"}}
+	r := <-ch
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	assertEquals(t, "pubsub.example.com", string(r.iq.From))
+
+	req = testIq("pubsub.example.com")
+	ch = sendIqAsync(cl, context.Background(), req)
+	out = (<-sent).(*Iq)
+	reply := out.ErrorReply(NewError(ErrorItemNotFound, ""))
+	reply.From = "pubsub.example.com"
+	recv <- reply
+	r = <-ch
+	if !errors.Is(r.err, ErrorItemNotFound) {
+		t.Errorf("wrong error %v", r.err)
+	}
+	if r.iq == nil || r.iq.Type != "error" {
+		t.Errorf("no error reply: %v", r.iq)
+	}
+}
+
+func TestSendIqToServer(t *testing.T) {
+	cl, recv, sent := newTestClient()
+	defer close(recv)
+
+	for _, from := range []JID{"", "me@example.com", "example.com",
+		"me@example.com/res"} {
+		ch := sendIqAsync(cl, context.Background(),
+			testIq(""))
+		out := (<-sent).(*Iq)
+		recv <- &Iq{Header: Header{From: from, Id: out.Id,
+			Type: "result"}}
+		if r := <-ch; r.err != nil {
+			t.Errorf("from %q: %v", from, r.err)
+		}
+	}
+}
+
+func TestSendIqTimeout(t *testing.T) {
+	cl, recv, sent := newTestClient()
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	ch := sendIqAsync(cl, ctx, testIq(""))
+	<-sent
+	r := <-ch
+	if !errors.Is(r.err, context.DeadlineExceeded) {
+		t.Errorf("wrong error %v", r.err)
+	}
+
+	// Shutting down abandons any requests in progress.
+	ch = sendIqAsync(cl, context.Background(),
+		testIq(""))
+	<-sent
+	close(recv)
+	select {
+	case r = <-ch:
+		if r.err == nil {
+			t.Error("no error after shutdown")
+		}
+	case <-time.After(time.Second):
+		t.Error("still waiting after shutdown")
+	}
+}
+
+func TestSendStanzaInvalid(t *testing.T) {
+	cl, recv, sent := newTestClient()
+	defer close(recv)
+	ctx := context.Background()
+	bad := &Iq{Header: Header{To: "example.com", Type: "get"}}
+	if err := cl.SendStanza(ctx, bad); err == nil {
+		t.Error("sent iq without an id")
+	}
+	msg := NewMessage("you@example.com", MessageChat, "hi")
+	if err := cl.SendStanza(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if st := <-sent; st != msg {
+		t.Errorf("sent %v", st)
+	}
+}
+
+func TestSendAfterClose(t *testing.T) {
+	cl, recv, _ := newTestClient()
+	cl.Close()
+	close(recv)
+	<-cl.done
+	for i := 0; i < 10; i++ {
+		iq := testIq("example.com")
+		iq.Id = cl.NextId()
+		if err := cl.send(context.Background(), iq); !errors.Is(err,
+			errShutdown) {
+			t.Fatalf("send after close: %v", err)
+		}
+	}
+}
+
+func TestRouteIq(t *testing.T) {
+	cl := &Client{Jid: "me@example.com/res"}
+	cl.done = make(chan struct{})
+	sent := make(chan Stanza, 10)
+	cl.Send = sent
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	go cl.routeIq(in, out)
+	defer close(in)
+
+	name := xml.Name{Space: "urn:example", Local: "query"}
+	cl.HandleIq("get", name, func(iq *Iq) *Iq {
+		return iq.Reply()
+	})
+
+	in <- &Iq{Header: Header{From: "you@example.com/a", Id: "1",
+		Type: "get", Innerxml: `<query xmlns="urn:example"/>`}}
+	reply := (<-sent).(*Iq)
+	assertEquals(t, "result", reply.Type)
+	assertEquals(t, "1", reply.Id)
+	assertEquals(t, "you@example.com/a", string(reply.To))
+
+	// Same child, but nobody handles set.
+	in <- &Iq{Header: Header{From: "you@example.com/a", Id: "2",
+		Type: "set", Innerxml: `<query xmlns="urn:example"/>`}}
+	reply = (<-sent).(*Iq)
+	assertEquals(t, "error", reply.Type)
+	if !errors.Is(reply.Error, ErrorServiceUnavailable) {
+		t.Errorf("wrong error %v", reply.Error)
+	}
+
+	// Removing the handler makes it unavailable.
+	cl.HandleIq("get", name, nil)
+	in <- &Iq{Header: Header{Id: "3", Type: "get",
+		Innerxml: `<query xmlns="urn:example"/>`}}
+	reply = (<-sent).(*Iq)
+	assertEquals(t, "3", reply.Id)
+	assertEquals(t, "error", reply.Type)
+
+	// Requests for an ordered handler are answered in order.
+	cl.HandleIqInOrder("set", name, func(iq *Iq) *Iq {
+		return iq.Reply()
+	})
+	for _, id := range []string{"a", "b", "c"} {
+		in <- &Iq{Header: Header{Id: id, Type: "set",
+			Innerxml: `<query xmlns="urn:example"/>`}}
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		reply = (<-sent).(*Iq)
+		assertEquals(t, id, reply.Id)
+		assertEquals(t, "result", reply.Type)
+	}
+
+	// Everything else passes through.
+	res := &Iq{Header: Header{Id: "4", Type: "result"}}
+	in <- res
+	if st := <-out; st != res {
+		t.Errorf("got %v", st)
+	}
+	msg := &Message{}
+	in <- msg
+	if st := <-out; st != msg {
+		t.Errorf("got %v", st)
+	}
+}
+
+func TestIsReplyFrom(t *testing.T) {
+	cl := &Client{Jid: "me@example.com/res"}
+	tests := []struct {
+		to, from JID
+		ok       bool
+	}{
+		{"", "", true},
+		{"", "example.com", true},
+		{"", "me@example.com", true},
+		{"", "ME@Example.COM/res", true},
+		{"", "me@example.com/other", false},
+		{"", "you@example.com", false},
+		{"me@example.com", "", true},
+		{"me@example.com", "example.com", true},
+		{"example.com", "", true},
+		{"example.com", "example.com", true},
+		{"example.com", "evil.example.com", false},
+		{"you@example.com/a", "you@example.com/a", true},
+		{"you@example.com/a", "you@example.com/A", false},
+		{"you@example.com/a", "you@example.com", false},
+		{"you@example.com/a", "", false},
+		{"pubsub.example.com", "example.com", false},
+	}
+	for _, test := range tests {
+		if ok := cl.isReplyFrom(test.to, test.from); ok != test.ok {
+			t.Errorf("to %q from %q: got %v", test.to, test.from,
+				ok)
+		}
+	}
+}
+
+func TestCallbackOrigin(t *testing.T) {
+	cl, recv, _ := newTestClient()
+	defer close(recv)
+
+	called := make(chan Stanza, 2)
+	cl.SetReplyCallback("id_1", "you@example.com/a", func(st Stanza) {
+		called <- st
+	})
+	spoof := &Iq{Header: Header{From: "evil@example.com/x", Id: "id_1",
+		Type: "result"}}
+	msg := &Message{Header: Header{From: "evil@example.com/x",
+		Id: "id_1"}}
+	good := &Iq{Header: Header{From: "you@example.com/a", Id: "id_1",
+		Type: "result"}}
+	recv <- spoof
+	recv <- msg
+	recv <- good
+	if st := <-called; st != good {
+		t.Errorf("callback got %v", st)
+	}
+	select {
+	case st := <-called:
+		t.Errorf("called again with %v", st)
+	default:
+	}
+
+	// Without a destination, any stanza with the id will do.
+	cl.SetCallback("id_2", func(st Stanza) { called <- st })
+	msg = &Message{Header: Header{From: "you@example.com/b",
+		Id: "id_2"}}
+	recv <- msg
+	if st := <-called; st != msg {
+		t.Errorf("callback got %v", st)
+	}
+}
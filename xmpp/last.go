@@ -0,0 +1,105 @@
+package xmpp
+
+// This file contains support for last activity queries, XEP-0012.
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const NsLast = "jabber:iq:last"
+
+// A last activity query or result. Sent to a client, it asks how long
+// the user has been idle.
+type LastQuery struct {
+	XMLName xml.Name `xml:"jabber:iq:last query"`
+	// Absent in a query.
+	Seconds *int `xml:"seconds,attr"`
+	// The status of an account that's gone offline, when asking
+	// about one.
+	Status string `xml:",chardata"`
+}
+
+// Creates an extension which tells our contacts how long we've been
+// idle. If idle is nil, the idle time is the time since we last sent
+// a message or changed our presence. Only entities which can see our
+// presence get an answer. XEP-0012, section 7.
+func NewLastActivityResponder(idle func() time.Duration) Extension {
+	qName := xml.Name{Space: NsLast, Local: "query"}
+	ext := Extension{StanzaTypes: map[xml.Name]reflect.Type{
+		qName: reflect.TypeOf(LastQuery{})}}
+	if idle == nil {
+		var lock sync.Mutex
+		last := time.Now()
+		idle = func() time.Duration {
+			lock.Lock()
+			defer lock.Unlock()
+			return time.Since(last)
+		}
+		ext.SendFilter = func(in <-chan Stanza, out chan<- Stanza) {
+			defer close(out)
+			for st := range in {
+				switch st.(type) {
+				case *Message, *Presence:
+					lock.Lock()
+					last = time.Now()
+					lock.Unlock()
+				}
+				out <- st
+			}
+		}
+	}
+	ext.Init = func(cl *Client) {
+		cl.Disco.AddFeature(NsLast)
+		cl.HandleIq("get", qName, func(iq *Iq) *Iq {
+			if !cl.canSeePresence(iq.From) {
+				return iq.ErrorReply(NewError(ErrorForbidden,
+					""))
+			}
+			secs := int(idle() / time.Second)
+			return iq.Reply(&LastQuery{Seconds: &secs})
+		})
+	}
+	return ext
+}
+
+// Is the entity allowed to see our presence? Our own account and
+// server can, as can contacts who have a subscription to it. Until
+// the roster arrives, contacts can't.
+func (cl *Client) canSeePresence(jid JID) bool {
+	bare := jid.Bare()
+	if jid == "" || sameJid(bare, cl.Jid.Bare()) ||
+		sameJid(jid, JID(cl.Jid.Domain())) {
+		return true
+	}
+	for _, item := range cl.Roster.snapshot() {
+		if sameJid(item.Jid, bare) {
+			return item.Subscription == "from" ||
+				item.Subscription == "both"
+		}
+	}
+	return false
+}
+
+// Ask how long a contact's client has been idle. Asked of a bare JID,
+// this is how long ago the contact went offline, along with their
+// last status message.
+func (cl *Client) QueryLastActivity(ctx context.Context,
+	to JID) (time.Duration, string, error) {
+
+	reply, err := cl.SendIq(ctx, NewIq(IqGet, to, &LastQuery{}))
+	if err != nil {
+		return 0, "", err
+	}
+	for _, ele := range reply.Nested {
+		if q, ok := ele.(*LastQuery); ok && q.Seconds != nil {
+			return time.Duration(*q.Seconds) * time.Second,
+				q.Status, nil
+		}
+	}
+	return 0, "", fmt.Errorf("no last activity in reply from %s", to)
+}
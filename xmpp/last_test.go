@@ -0,0 +1,77 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLastActivityResponder(t *testing.T) {
+	cl, recv, sent := newTestClient()
+	defer close(recv)
+	cl.Disco = newDisco()
+	r := newRosterExt()
+	r.client = cl
+	cl.Roster = *r
+	r.Init(cl)
+
+	ext := NewLastActivityResponder(func() time.Duration {
+		return 90 * time.Second
+	})
+	ext.Init(cl)
+	h := cl.iqHandler("get", xml.Name{Space: NsLast, Local: "query"})
+	ask := func(from JID) *Iq {
+		req := &Iq{Header: Header{From: from, Id: "1", Type: "get"}}
+		req.Nested = []interface{}{&LastQuery{}}
+		return h(req)
+	}
+
+	// Without a roster, we don't know who our contacts are, but
+	// we don't wait to find out.
+	if reply := ask("friend@example.com/a"); !errors.Is(reply.Error,
+		ErrorForbidden) {
+		t.Errorf("before roster got %v", reply)
+	}
+
+	r.update()
+	iq := (<-sent).(*Iq)
+	recv <- iq.Reply(&RosterQuery{Item: []RosterItem{
+		{Jid: "friend@example.com", Subscription: "both"},
+		{Jid: "fan@example.com", Subscription: "to"}}})
+	r.Get()
+
+	exp := `<iq to="friend@example.com/a" id="1" type="result">` +
+		`<query xmlns="jabber:iq:last" seconds="90"></query></iq>`
+	assertMarshal(t, exp, ask("friend@example.com/a"))
+	assertEquals(t, "result", ask("me@example.com/other").Type)
+	for _, from := range []JID{"fan@example.com/a",
+		"stranger@example.com/a"} {
+		if reply := ask(from); !errors.Is(reply.Error,
+			ErrorForbidden) {
+			t.Errorf("%s got %v", from, reply)
+		}
+	}
+}
+
+func TestLastActivityIdle(t *testing.T) {
+	ext := NewLastActivityResponder(nil)
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	go ext.SendFilter(in, out)
+	defer close(in)
+	in <- NewMessage("you@example.com", MessageChat, "hi")
+	<-out
+
+	cl := &Client{Jid: "me@example.com/res"}
+	cl.Disco = newDisco()
+	ext.Init(cl)
+	h := cl.iqHandler("get", xml.Name{Space: NsLast, Local: "query"})
+	req := &Iq{Header: Header{Id: "1", Type: "get"}}
+	req.Nested = []interface{}{&LastQuery{}}
+	reply := h(req)
+	q := reply.Nested[0].(*LastQuery)
+	if q.Seconds == nil || *q.Seconds != 0 {
+		t.Errorf("got %v", reply)
+	}
+}
@@ -5,6 +5,7 @@ package xmpp
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -17,27 +18,39 @@ var Debug = false
 
 var l1interval = time.Second
 
+// How long to wait for the server to complete the TLS handshake.
+var tlsTimeout = 30 * time.Second
+
+// The server hung up without closing the stream first.
+var errUnexpectedClose = errors.New("connection closed by server")
+
 type layer1 struct {
 	sock      net.Conn
 	recvSocks chan<- net.Conn
 	sendSocks chan net.Conn
+	// Closed when this connection has been replaced by another.
+	retired chan struct{}
 }
 
-func (cl *Client) startLayer1(sock net.Conn, recvWriter io.WriteCloser,
+func (cl *Client) startLayer1(sock net.Conn, recvWriter *io.PipeWriter,
 	sendReader io.ReadCloser, status <-chan Status) *layer1 {
 	l1 := layer1{sock: sock}
 	recvSocks := make(chan net.Conn)
 	l1.recvSocks = recvSocks
 	sendSocks := make(chan net.Conn, 1)
 	l1.sendSocks = sendSocks
-	go cl.recvTransport(recvSocks, recvWriter, status)
-	go cl.sendTransport(sendSocks, sendReader)
+	l1.retired = make(chan struct{})
+	go cl.recvTransport(recvSocks, recvWriter, status, l1.retired)
+	go cl.sendTransport(sendSocks, sendReader, l1.retired)
 	recvSocks <- sock
 	sendSocks <- sock
 	return &l1
 }
 
-func (l1 *layer1) startTls(conf *tls.Config) {
+// Switch both transports over to TLS. The handshake is completed here,
+// so certificate problems are reported to the caller rather than
+// showing up later as read errors.
+func (l1 *layer1) startTls(conf *tls.Config) error {
 	sendSockToSender := func(sock net.Conn) {
 		for {
 			select {
@@ -50,24 +63,42 @@ func (l1 *layer1) startTls(conf *tls.Config) {
 
 	sendSockToSender(nil)
 	l1.recvSocks <- nil
-	l1.sock = tls.Client(l1.sock, conf)
+	tlsSock := tls.Client(l1.sock, conf)
+	l1.sock.SetDeadline(time.Now().Add(tlsTimeout))
+	if err := tlsSock.Handshake(); err != nil {
+		l1.sock.Close()
+		return err
+	}
+	l1.sock.SetDeadline(time.Time{})
+	l1.sock = tlsSock
 	sendSockToSender(l1.sock)
 	l1.recvSocks <- l1.sock
+	return nil
 }
 
-func (cl *Client) recvTransport(socks <-chan net.Conn, w io.WriteCloser,
-	status <-chan Status) {
+// Stop using this connection, after the server has sent us somewhere
+// else. Errors from it are no longer of interest.
+func (l1 *layer1) retire() {
+	close(l1.retired)
+}
+
+// Copy bytes from the socket to the XML layer. Layer 2 is told why
+// the bytes stopped coming: errUnexpectedClose if the server hung up,
+// errShutdown if we did.
+func (cl *Client) recvTransport(socks <-chan net.Conn, w *io.PipeWriter,
+	status <-chan Status, retired <-chan struct{}) {
 
-	defer w.Close()
+	defer w.CloseWithError(errShutdown)
 	var sock net.Conn
 	p := make([]byte, 1024)
 	for {
 		select {
-		case stat := <-status:
-			if stat.Fatal() {
+		case stat, ok := <-status:
+			if !ok || stat.Fatal() {
 				return
 			}
-
+		case <-retired:
+			return
 		case sock = <-socks:
 		default:
 		}
@@ -83,7 +114,18 @@ func (cl *Client) recvTransport(socks <-chan net.Conn, w io.WriteCloser,
 						continue
 					}
 				}
-				cl.setError(fmt.Errorf("recv: %v", err))
+				// Let the XML layer finish with what
+				// it has. It knows whether the server
+				// closed the stream properly first.
+				if err == io.EOF {
+					w.CloseWithError(errUnexpectedClose)
+					return
+				}
+				select {
+				case <-retired:
+				default:
+					cl.setError(fmt.Errorf("recv: %v", err))
+				}
 				return
 			}
 			if Debug {
@@ -98,13 +140,19 @@ func (cl *Client) recvTransport(socks <-chan net.Conn, w io.WriteCloser,
 	}
 }
 
-func (cl *Client) sendTransport(socks <-chan net.Conn, r io.Reader) {
+func (cl *Client) sendTransport(socks <-chan net.Conn, r io.Reader,
+	retired <-chan struct{}) {
+
 	var sock net.Conn
 	p := make([]byte, 1024)
 	for {
 		nr, err := r.Read(p)
 		if nr == 0 {
-			cl.setError(fmt.Errorf("send: %v", err))
+			// EOF means layer 2 is done with this
+			// connection.
+			if err != io.EOF {
+				cl.setError(fmt.Errorf("send: %v", err))
+			}
 			break
 		}
 		if nr > 0 && Debug {
@@ -125,7 +173,12 @@ func (cl *Client) sendTransport(socks <-chan net.Conn, r io.Reader) {
 				nw, err := sock.Write(p[:nr])
 				nr -= nw
 				if nr != 0 {
-					cl.setError(fmt.Errorf("send: %v", err))
+					select {
+					case <-retired:
+					default:
+						cl.setError(fmt.Errorf("send: %v",
+							err))
+					}
 					break
 				}
 			}
@@ -5,6 +5,7 @@ package xmpp
 
 import (
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -13,11 +14,16 @@ import (
 )
 
 // Read bytes from a reader, unmarshal them as XML into structures of
-// the appropriate type, and send those structures on a channel.
+// the appropriate type, and send those structures on a channel. If
+// the bytes run out before the server has closed the stream, that's
+// an error, unless it's because we shut down.
 func (cl *Client) recvXml(r io.Reader, ch chan<- interface{},
 	extStanza map[xml.Name]reflect.Type) {
 
 	defer close(ch)
+	// Whatever's left isn't of interest, but layer 1 mustn't get
+	// stuck trying to give it to us.
+	defer io.Copy(io.Discard, r)
 
 	// This trick loads our namespaces into the parser.
 	nsstr := fmt.Sprintf(`<a xmlns="%s" xmlns:stream="%s">`,
@@ -31,11 +37,15 @@ Loop:
 		// Sniff the next token on the stream.
 		t, err := p.Token()
 		if t == nil {
-			if err != io.EOF {
-				cl.setError(fmt.Errorf("recv: %v", err))
+			if !errors.Is(err, errShutdown) {
+				cl.setError(fmt.Errorf("recv: %w", err))
 			}
 			break
 		}
+		if ee, ok := t.(xml.EndElement); ok &&
+			ee.Name.Space == NsStream && ee.Name.Local == "stream" {
+			break
+		}
 		var se xml.StartElement
 		var ok bool
 		if se, ok = t.(xml.StartElement); !ok {
@@ -96,6 +106,12 @@ Loop:
 
 		// Put it on the channel.
 		ch <- obj
+
+		// Nothing useful follows a stream error, and the
+		// server is about to close the connection.
+		if _, ok := obj.(*streamError); ok {
+			break
+		}
 	}
 }
 
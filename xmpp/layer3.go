@@ -9,10 +9,15 @@ import (
 	"log"
 )
 
-// Callback to handle a stanza with a particular id.
+// Callback to handle a stanza with a particular id. A callback with
+// a nil f cancels the one previously registered for that id.
 type callback struct {
 	id string
-	f  func(Stanza)
+	// If set, only an iq result or error from where the request
+	// was sent will do.
+	reply bool
+	to    JID
+	f     func(Stanza)
 }
 
 // Receive XMPP stanzas from the client and send them on to the
@@ -21,8 +26,8 @@ type callback struct {
 // binding is complete. Otherwise the app might inject something
 // inappropriate into our negotiations with the server. The control
 // channel controls this loop's activity.
-func sendStream(sendXml chan<- interface{}, recvXmpp <-chan Stanza,
-	status <-chan Status) {
+func (cl *Client) sendStream(sendXml chan<- interface{},
+	recvXmpp <-chan Stanza, status <-chan Status) {
 	defer close(sendXml)
 
 	var input <-chan Stanza
@@ -42,12 +47,18 @@ func sendStream(sendXml chan<- interface{}, recvXmpp <-chan Stanza,
 			if !ok {
 				return
 			}
-			if x == nil {
+			if err := Validate(x); err != nil {
 				if Debug {
-					log.Println("Won't send nil stanza")
+					log.Printf("Won't send %#v: %v", x,
+						err)
 				}
 				continue
 			}
+			if p, ok := x.(*Presence); ok && p.To == "" {
+				cl.presLock.Lock()
+				cl.presence = p
+				cl.presLock.Unlock()
+			}
 			sendXml <- x
 		}
 	}
@@ -59,9 +70,14 @@ func (cl *Client) recvStream(recvXml <-chan interface{}, sendXmpp chan<- Stanza,
 	status <-chan Status) {
 	defer close(sendXmpp)
 	defer cl.statmgr.close()
+	defer close(cl.done)
 
-	handlers := make(map[string]func(Stanza))
+	handlers := make(map[string]*callback)
 	doSend := false
+	// Redirects since the session was last running, and where
+	// they took us.
+	redirects := 0
+	var seen map[string]bool
 	for {
 		select {
 		case stat := <-status:
@@ -70,19 +86,57 @@ func (cl *Client) recvStream(recvXml <-chan interface{}, sendXmpp chan<- Stanza,
 				doSend = false
 			case StatusRunning:
 				doSend = true
+				redirects = 0
 			}
 		case h := <-cl.handlers:
-			handlers[h.id] = h.f
+			addHandler(handlers, h)
 		case x, ok := <-recvXml:
 			if !ok {
 				return
 			}
+			// A callback registered before its request was
+			// sent may still be waiting in the channel.
+		Drain:
+			for {
+				select {
+				case h := <-cl.handlers:
+					addHandler(handlers, h)
+				default:
+					break Drain
+				}
+			}
 			switch obj := x.(type) {
 			case *stream:
 				// Do nothing.
 			case *streamError:
-				cl.setError(fmt.Errorf("%#v", obj))
-				return
+				err := obj.streamError()
+				// Redirects while connecting are
+				// handled by newClient, and those
+				// once running only if we were asked
+				// to.
+				if err.Condition != StreamSeeOtherHost ||
+					(!doSend && redirects == 0) ||
+					!cl.followRedirects {
+					cl.setError(err)
+					return
+				}
+				if redirects == maxRedirects {
+					cl.setError(fmt.Errorf("too many"+
+						" redirects: %v", err))
+					return
+				}
+				if redirects == 0 {
+					addr := cl.layer1.sock.RemoteAddr()
+					seen = map[string]bool{
+						addr.String(): true}
+				}
+				redirects++
+				ch, rerr := cl.redirect(err.OtherHost, seen)
+				if rerr != nil {
+					cl.setError(rerr)
+					return
+				}
+				recvXml = ch
 			case *Features:
 				cl.handleFeatures(obj)
 			case *starttls:
@@ -90,11 +144,20 @@ func (cl *Client) recvStream(recvXml <-chan interface{}, sendXmpp chan<- Stanza,
 			case *auth:
 				cl.handleSasl(obj)
 			case Stanza:
-				id := obj.GetHeader().Id
-				if handlers[id] != nil {
-					f := handlers[id]
-					delete(handlers, id)
-					f(obj)
+				hdr := obj.GetHeader()
+				h, forged := cl.callbackFor(handlers, obj)
+				if forged {
+					if Debug {
+						log.Printf("Dropping %s from"+
+							" %s, expected %s",
+							hdr.Id, hdr.From,
+							h.to)
+					}
+					continue
+				}
+				if h != nil {
+					delete(handlers, hdr.Id)
+					h.f(obj)
 				}
 				if doSend {
 					sendXmpp <- obj
@@ -109,6 +172,33 @@ func (cl *Client) recvStream(recvXml <-chan interface{}, sendXmpp chan<- Stanza,
 	}
 }
 
+// Find the callback waiting for this stanza, if any. A callback
+// waiting for a reply only wants an iq result or error, and ids are
+// easy to guess, so the reply must also come from where the request
+// was sent; if it doesn't, it's forged.
+func (cl *Client) callbackFor(handlers map[string]*callback,
+	st Stanza) (h *callback, forged bool) {
+
+	hdr := st.GetHeader()
+	h = handlers[hdr.Id]
+	if h == nil || !h.reply {
+		return h, false
+	}
+	if iq, ok := st.(*Iq); !ok || (iq.Type != "result" &&
+		iq.Type != "error") {
+		return nil, false
+	}
+	return h, !cl.isReplyFrom(h.to, hdr.From)
+}
+
+func addHandler(handlers map[string]*callback, h *callback) {
+	if h.f == nil {
+		delete(handlers, h.id)
+	} else {
+		handlers[h.id] = h
+	}
+}
+
 func (cl *Client) handleFeatures(fe *Features) {
 	cl.Features = fe
 	if fe.Starttls != nil {
@@ -130,7 +220,11 @@ func (cl *Client) handleFeatures(fe *Features) {
 }
 
 func (cl *Client) handleTls(t *starttls) {
-	cl.layer1.startTls(&cl.tlsConfig)
+	err := cl.layer1.startTls(cl.tlsConfigFor(cl.Jid.Domain()))
+	if err != nil {
+		cl.setError(fmt.Errorf("TLS: %w", err))
+		return
+	}
 
 	cl.setStatus(StatusConnectedTls)
 
@@ -146,7 +240,7 @@ func (cl *Client) bind() {
 	if res != "" {
 		bindReq.Resource = &res
 	}
-	msg := &Iq{Header: Header{Type: "set", Id: NextId(),
+	msg := &Iq{Header: Header{Type: "set", Id: cl.NextId(),
 		Nested: []interface{}{bindReq}}}
 	f := func(st Stanza) {
 		iq, ok := st.(*Iq)
@@ -179,17 +273,28 @@ func (cl *Client) bind() {
 		cl.Jid = JID(*jid)
 		cl.setStatus(StatusBound)
 	}
-	cl.SetCallback(msg.Id, f)
+	cl.SetReplyCallback(msg.Id, msg.To, f)
 	cl.sendRaw <- msg
 }
 
 // Register a callback to handle the next XMPP stanza (iq, message, or
 // presence) with a given id. The provided function will not be called
-// more than once. If it returns false, the stanza will not be made
-// available on the normal Client.Recv channel. The callback must not
-// read from that channel, as deliveries on it cannot proceed until
-// the handler returns true or false.
+// more than once. The stanza is still made available on the normal
+// Client.Recv channel afterwards. The callback must not read from
+// that channel, as deliveries on it cannot proceed until the callback
+// returns. Ids are easy to guess; SetReplyCallback only accepts a
+// reply from where the request was sent.
 func (cl *Client) SetCallback(id string, f func(Stanza)) {
 	h := &callback{id: id, f: f}
 	cl.handlers <- h
 }
+
+// Like SetCallback, but for the reply to an iq request addressed to
+// "to": only an iq result or error with the given id from there is
+// handed to the callback. Other stanzas with that id are delivered as
+// usual, and iq replies from anybody else are discarded, so the
+// callback can't be triggered by a forged reply.
+func (cl *Client) SetReplyCallback(id string, to JID, f func(Stanza)) {
+	h := &callback{id: id, reply: true, to: to, f: f}
+	cl.handlers <- h
+}
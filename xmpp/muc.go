@@ -0,0 +1,648 @@
+package xmpp
+
+// This file contains support for multi-user chat, XEP-0045.
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	NsMuc     = "http://jabber.org/protocol/muc"
+	NsMucUser = "http://jabber.org/protocol/muc#user"
+)
+
+// Values for affiliations. XEP-0045, section 5.2.
+const (
+	AffiliationOwner   = "owner"
+	AffiliationAdmin   = "admin"
+	AffiliationMember  = "member"
+	AffiliationOutcast = "outcast"
+	AffiliationNone    = "none"
+)
+
+// Values for roles. XEP-0045, section 5.1.
+const (
+	RoleModerator   = "moderator"
+	RoleParticipant = "participant"
+	RoleVisitor     = "visitor"
+	RoleNone        = "none"
+)
+
+// Some of the status codes in muc#user elements. XEP-0045, section
+// 15.6.
+const (
+	MucStatusRealJids   = 100
+	MucStatusConfig     = 104
+	MucStatusSelf       = 110
+	MucStatusCreated    = 201
+	MucStatusNickFixed  = 210
+	MucStatusBanned     = 301
+	MucStatusNewNick    = 303
+	MucStatusKicked     = 307
+	MucStatusRemoved    = 321
+	MucStatusMembersOff = 322
+	MucStatusShutdown   = 332
+)
+
+// Sent in presence to a room to join it.
+type MucJoin struct {
+	XMLName  xml.Name    `xml:"http://jabber.org/protocol/muc x"`
+	Password string      `xml:"password,omitempty"`
+	History  *MucHistory `xml:"history"`
+}
+
+// How much of the room's history to send when joining. Unset fields
+// leave it up to the room.
+type MucHistory struct {
+	MaxChars   *int `xml:"maxchars,attr"`
+	MaxStanzas *int `xml:"maxstanzas,attr"`
+	Seconds    *int `xml:"seconds,attr"`
+	// A time in XEP-0082 format.
+	Since string `xml:"since,attr,omitempty"`
+}
+
+// The muc#user element, in presence and messages from a room.
+type MucUser struct {
+	XMLName  xml.Name    `xml:"http://jabber.org/protocol/muc#user x"`
+	Items    []MucItem   `xml:"item"`
+	Status   []MucStatus `xml:"status"`
+	Destroy  *MucDestroy `xml:"destroy"`
+	Invite   []MucInvite `xml:"invite"`
+	Decline  *MucInvite  `xml:"decline"`
+	Password string      `xml:"password,omitempty"`
+}
+
+// An occupant's or user's standing in a room.
+type MucItem struct {
+	Affiliation string    `xml:"affiliation,attr,omitempty"`
+	Role        string    `xml:"role,attr,omitempty"`
+	Jid         JID       `xml:"jid,attr,omitempty"`
+	Nick        string    `xml:"nick,attr,omitempty"`
+	Actor       *MucActor `xml:"actor"`
+	Reason      string    `xml:"reason,omitempty"`
+}
+
+// Who did something to an occupant.
+type MucActor struct {
+	Jid  JID    `xml:"jid,attr,omitempty"`
+	Nick string `xml:"nick,attr,omitempty"`
+}
+
+type MucStatus struct {
+	Code int `xml:"code,attr"`
+}
+
+// Says a room has been destroyed, and perhaps where to go instead.
+type MucDestroy struct {
+	Jid      JID    `xml:"jid,attr,omitempty"`
+	Reason   string `xml:"reason,omitempty"`
+	Password string `xml:"password,omitempty"`
+}
+
+// Muc joins multi-user chat rooms. Include its Extension in the list
+// given to NewClient. Stanzas from rooms we're in are delivered as
+// the room's events, not on Client.Recv. If the client disconnects,
+// give the same Muc to the next one, and it will rejoin the rooms.
+type Muc struct {
+	Extension
+	lock   sync.Mutex
+	rooms  map[JID]*Room
+	client *Client
+	// How long a room can be quiet before we ping it.
+	pingInterval time.Duration
+	// Set by AutoAccept.
+	autoNick  string
+	autoRooms chan<- *Room
+}
+
+// Options for joining a room.
+type JoinOptions struct {
+	Password string
+	// How much history to ask for. Nil leaves it up to the room.
+	History *MucHistory
+}
+
+// A room we've joined, or are joining.
+type Room struct {
+	// The room's bare JID.
+	Jid JID
+	// Events in the room. This must be read promptly, until it's
+	// closed.
+	Events <-chan RoomEvent
+	muc    *Muc
+	lock   sync.Mutex
+	// The client we joined with.
+	client   *Client
+	nick     string
+	password string
+	// Keyed by nick.
+	occupants map[string]Occupant
+	// New nick to old, for occupants who are changing nick.
+	renamed map[string]string
+	subject string
+	joined  bool
+	created bool
+	closed  bool
+	// We were in the room, and want to get back in.
+	lost      bool
+	lostAt    time.Time
+	rejoining bool
+	// When we last heard from the room.
+	lastSeen time.Time
+	pinging  bool
+	// Gets the outcome of joining.
+	joinResult chan error
+	queue      chan RoomEvent
+	gone       chan struct{}
+}
+
+// Somebody in a room.
+type Occupant struct {
+	Nick string
+	// The occupant's real JID, if the room lets us see it.
+	Jid         JID
+	Affiliation string
+	Role        string
+	Show        PresenceShow
+	Status      string
+}
+
+// What happened in a room.
+type RoomEventType int
+
+const (
+	// Somebody entered the room.
+	OccupantJoined RoomEventType = iota
+	// Somebody left. Status and Reason say whether they were
+	// kicked or banned.
+	OccupantLeft
+	// An occupant's presence, role, or affiliation changed.
+	OccupantChanged
+	// An occupant changed nick, from OldNick.
+	OccupantNickChanged
+	// A message arrived: groupchat, or private from an occupant,
+	// or from the room itself.
+	RoomMessage
+	// The subject changed.
+	RoomSubject
+	// We're no longer in the room. Status and Reason say whether
+	// we left, were kicked or banned, or the room went away. This
+	// is the last event.
+	RoomLeft
+	// The room was destroyed. Destroy may name a replacement.
+	// This is the last event.
+	RoomDestroyed
+	// We've dropped out of the room, perhaps because the client
+	// disconnected, and the occupants are forgotten. We'll try to
+	// rejoin; call Leave to give up instead.
+	RoomDisconnected
+	// We're back in the room, and OccupantJoined events have been
+	// sent for everybody there.
+	RoomRejoined
+	// Somebody we invited via the room, Invitee, won't be coming.
+	InviteDeclined
+)
+
+type RoomEvent struct {
+	Type     RoomEventType
+	Occupant Occupant
+	OldNick  string
+	Message  *Message
+	Status   []int
+	Reason   string
+	Destroy  *MucDestroy
+	Invitee  JID
+}
+
+// Creates the multi-user chat extension.
+func NewMuc() *Muc {
+	m := &Muc{rooms: make(map[JID]*Room), pingInterval: mucPingInterval}
+	m.StanzaTypes = make(map[xml.Name]reflect.Type)
+	m.StanzaTypes[xml.Name{Space: NsMucUser, Local: "x"}] =
+		reflect.TypeOf(MucUser{})
+	m.StanzaTypes[xml.Name{Space: NsMucAdmin, Local: "query"}] =
+		reflect.TypeOf(MucAdminQuery{})
+	m.StanzaTypes[xml.Name{Space: NsMucOwner, Local: "query"}] =
+		reflect.TypeOf(MucOwnerQuery{})
+	m.StanzaTypes[xml.Name{Space: NsConference, Local: "x"}] =
+		reflect.TypeOf(DirectInvite{})
+	m.RecvFilter = m.recvFilter
+	m.Init = func(cl *Client) {
+		m.lock.Lock()
+		m.client = cl
+		m.lock.Unlock()
+		cl.Disco.AddFeature(NsMuc, NsConference)
+		go m.watch(cl, cl.statmgr.newQueuedListener())
+	}
+	return m
+}
+
+func (m *Muc) getClient() *Client {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.client
+}
+
+// Returns a room we're in, or nil.
+func (m *Muc) Room(jid JID) *Room {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.rooms[jid.Bare()]
+}
+
+// Join a room with the given nick, and wait until we're in. If the
+// nick is taken, the error is an *Error with condition ErrorConflict,
+// and another nick may be tried. The server may change our nick; see
+// Room.Nick. If this creates the room, it must be configured before
+// anyone else can join; see Room.Created.
+func (m *Muc) Join(ctx context.Context, room JID, nick string,
+	opts *JoinOptions) (*Room, error) {
+
+	if opts == nil {
+		opts = &JoinOptions{}
+	}
+	m.lock.Lock()
+	if m.rooms[room.Bare()] != nil {
+		m.lock.Unlock()
+		return nil, fmt.Errorf("already in %s", room.Bare())
+	}
+	r := m.newRoom(room.Bare(), nick)
+	r.password = opts.Password
+	m.rooms[r.Jid] = r
+	cl := m.client
+	m.lock.Unlock()
+
+	err := r.join(ctx, cl, nick, opts.Password, opts.History)
+	if err != nil {
+		if ctx.Err() != nil {
+			// The room may let us in after we've given
+			// up, so tell it we're not coming.
+			p := &Presence{Header: Header{To: r.occupantJid(nick),
+				Type: string(PresenceUnavailable)}}
+			cl.send(context.Background(), p)
+		}
+		r.close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Send our presence to the room, and wait until it lets us in.
+func (r *Room) join(ctx context.Context, cl *Client, nick,
+	password string, history *MucHistory) error {
+
+	r.lock.Lock()
+	r.client = cl
+	r.lock.Unlock()
+	// Forget how any earlier attempt went.
+	select {
+	case <-r.joinResult:
+	default:
+	}
+	p := &Presence{Header: Header{To: r.occupantJid(nick)}}
+	p.Nested = []interface{}{&MucJoin{Password: password,
+		History: history}}
+	if err := cl.send(ctx, p); err != nil {
+		return err
+	}
+	select {
+	case err := <-r.joinResult:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-cl.done:
+		return cl.getError(errShutdown)
+	}
+}
+
+func (m *Muc) newRoom(jid JID, nick string) *Room {
+	r := &Room{Jid: jid, muc: m, nick: nick}
+	r.occupants = make(map[string]Occupant)
+	r.renamed = make(map[string]string)
+	r.joinResult = make(chan error, 1)
+	r.queue = make(chan RoomEvent)
+	r.gone = make(chan struct{})
+	events := make(chan RoomEvent)
+	r.Events = events
+	go queue(r.queue, events, nil)
+	return r
+}
+
+// Take stanzas from rooms out of the incoming stream.
+func (m *Muc) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for st := range in {
+		var r *Room
+		switch st.(type) {
+		case *Presence, *Message:
+			r = m.Room(st.GetHeader().From)
+		}
+		if r == nil {
+			if msg, ok := st.(*Message); ok {
+				m.noteInvitation(msg)
+			}
+			out <- st
+			continue
+		}
+		switch st := st.(type) {
+		case *Presence:
+			r.handlePresence(st)
+		case *Message:
+			r.handleMessage(st)
+		}
+	}
+}
+
+// Accept the direct invitation in the message, if there is one and
+// we're accepting invitations. Anybody can send an invitation that
+// claims to come via a room, so we don't act on those.
+func (m *Muc) noteInvitation(msg *Message) {
+	m.lock.Lock()
+	cl, nick, rooms := m.client, m.autoNick, m.autoRooms
+	m.lock.Unlock()
+	if nick == "" {
+		return
+	}
+	if inv := ParseInvitation(msg); inv != nil && inv.Direct {
+		go m.autoAccept(cl, inv, nick, rooms)
+	}
+}
+
+func (r *Room) occupantJid(nick string) JID {
+	return JID(string(r.Jid) + "/" + nick)
+}
+
+// Returns our nick in the room.
+func (r *Room) Nick() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.nick
+}
+
+// Returns the room's subject.
+func (r *Room) Subject() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.subject
+}
+
+// Returns everybody in the room, including us.
+func (r *Room) Occupants() []Occupant {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	list := make([]Occupant, 0, len(r.occupants))
+	for _, o := range r.occupants {
+		list = append(list, o)
+	}
+	return list
+}
+
+// Returns the occupant with the given nick.
+func (r *Room) Occupant(nick string) (Occupant, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	o, ok := r.occupants[nick]
+	return o, ok
+}
+
+// Send a message to everybody in the room.
+func (r *Room) Send(ctx context.Context, body string) error {
+	return r.muc.getClient().send(ctx, NewMessage(r.Jid, MessageGroupchat,
+		body))
+}
+
+// Send a private message to an occupant.
+func (r *Room) SendPrivate(ctx context.Context, nick, body string) error {
+	m := NewMessage(r.occupantJid(nick), MessageChat, body)
+	m.Nested = []interface{}{&MucUser{}}
+	return r.muc.getClient().send(ctx, m)
+}
+
+// Change the room's subject, if we're allowed to.
+func (r *Room) SetSubject(ctx context.Context, subject string) error {
+	m := NewMessage(r.Jid, MessageGroupchat, "")
+	m.Subject = []Text{{Chardata: subject}}
+	return r.muc.getClient().send(ctx, m)
+}
+
+// Leave the room, and wait until the room says we're gone. Status is
+// an optional message for the other occupants.
+func (r *Room) Leave(ctx context.Context, status string) error {
+	r.lock.Lock()
+	lost := r.lost
+	if lost {
+		r.emit(RoomEvent{Type: RoomLeft})
+	}
+	r.lock.Unlock()
+	if lost {
+		// There's nothing to leave.
+		r.close()
+		return nil
+	}
+	p := &Presence{Header: Header{To: r.occupantJid(r.Nick()),
+		Type: string(PresenceUnavailable)}}
+	if status != "" {
+		p.Status = []Text{{Chardata: status}}
+	}
+	cl := r.muc.getClient()
+	if err := cl.send(ctx, p); err != nil {
+		return err
+	}
+	select {
+	case <-r.gone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-cl.done:
+		return cl.getError(errShutdown)
+	}
+}
+
+// Forget the room, and finish its events.
+func (r *Room) close() {
+	m := r.muc
+	m.lock.Lock()
+	if m.rooms[r.Jid] == r {
+		delete(m.rooms, r.Jid)
+	}
+	m.lock.Unlock()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+		close(r.gone)
+	}
+}
+
+// Queue an event for the application. The caller holds r.lock.
+func (r *Room) emit(ev RoomEvent) {
+	if !r.closed {
+		r.queue <- ev
+	}
+}
+
+func mucUser(st Stanza) *MucUser {
+	for _, ele := range st.GetHeader().Nested {
+		if x, ok := ele.(*MucUser); ok {
+			return x
+		}
+	}
+	return nil
+}
+
+func (x *MucUser) hasStatus(code int) bool {
+	for _, s := range x.Status {
+		if s.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (x *MucUser) codes() []int {
+	var codes []int
+	for _, s := range x.Status {
+		codes = append(codes, s.Code)
+	}
+	return codes
+}
+
+func (r *Room) handlePresence(p *Presence) {
+	r.lock.Lock()
+	r.lastSeen = time.Now()
+	leaving := r.handlePresenceLocked(p)
+	r.lock.Unlock()
+	if leaving {
+		r.close()
+	}
+}
+
+// Update the occupants from a presence stanza. Returns true if we're
+// no longer in the room.
+func (r *Room) handlePresenceLocked(p *Presence) bool {
+	nick := p.From.Resource()
+	x := mucUser(p)
+	if x == nil {
+		x = &MucUser{}
+	}
+	var item MucItem
+	if len(x.Items) > 0 {
+		item = x.Items[0]
+	}
+	self := x.hasStatus(MucStatusSelf) || nick == r.nick
+
+	switch PresenceType(p.Type) {
+	case PresenceError:
+		if !r.joined && self {
+			var err error = p.Error
+			if p.Error == nil {
+				err = errors.New("can't join " + string(r.Jid))
+			}
+			r.finishJoin(err)
+		}
+		return false
+
+	case PresenceUnavailable:
+		old, known := r.occupants[nick]
+		if !known {
+			old = Occupant{Nick: nick, Jid: item.Jid,
+				Affiliation: item.Affiliation, Role: item.Role}
+		}
+		delete(r.occupants, nick)
+		if x.hasStatus(MucStatusNewNick) {
+			r.renamed[item.Nick] = nick
+			if self {
+				r.nick = item.Nick
+			}
+			return false
+		}
+		if !self {
+			r.emit(RoomEvent{Type: OccupantLeft, Occupant: old,
+				Status: x.codes(), Reason: item.Reason})
+			return false
+		}
+		if !r.joined {
+			if r.lost {
+				r.emit(RoomEvent{Type: RoomLeft,
+					Status: x.codes(), Reason: item.Reason})
+			}
+			r.finishJoin(fmt.Errorf("refused entry to %s",
+				r.Jid))
+			return true
+		}
+		if x.Destroy != nil {
+			r.emit(RoomEvent{Type: RoomDestroyed, Occupant: old,
+				Destroy: x.Destroy, Reason: x.Destroy.Reason})
+		} else {
+			r.emit(RoomEvent{Type: RoomLeft, Occupant: old,
+				Status: x.codes(), Reason: item.Reason})
+		}
+		return true
+
+	case PresenceAvailable:
+		o := Occupant{Nick: nick, Jid: item.Jid,
+			Affiliation: item.Affiliation, Role: item.Role,
+			Show: p.GetShow()}
+		if len(p.Status) > 0 {
+			o.Status = p.Status[0].Chardata
+		}
+		_, known := r.occupants[nick]
+		r.occupants[nick] = o
+		if oldNick, ok := r.renamed[nick]; ok {
+			delete(r.renamed, nick)
+			r.emit(RoomEvent{Type: OccupantNickChanged,
+				Occupant: o, OldNick: oldNick})
+		} else if known {
+			r.emit(RoomEvent{Type: OccupantChanged, Occupant: o})
+		} else {
+			r.emit(RoomEvent{Type: OccupantJoined, Occupant: o})
+		}
+		if self && !r.joined {
+			// The room may have changed our nick.
+			r.nick = nick
+			r.joined = true
+			r.created = x.hasStatus(MucStatusCreated)
+			if r.lost {
+				r.lost = false
+				r.emit(RoomEvent{Type: RoomRejoined})
+			}
+			r.finishJoin(nil)
+		}
+	}
+	return false
+}
+
+// Tell Join how it went, unless it's already been told.
+func (r *Room) finishJoin(err error) {
+	select {
+	case r.joinResult <- err:
+	default:
+	}
+}
+
+func (r *Room) handleMessage(m *Message) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lastSeen = time.Now()
+	if x := mucUser(m); x != nil && x.Decline != nil {
+		r.emit(RoomEvent{Type: InviteDeclined, Message: m,
+			Invitee: x.Decline.From, Reason: x.Decline.Reason})
+		return
+	}
+	if MessageType(m.Type) == MessageGroupchat && len(m.Subject) > 0 &&
+		len(m.Body) == 0 {
+		r.subject = m.Subject[0].Chardata
+		r.emit(RoomEvent{Type: RoomSubject, Message: m,
+			Occupant: r.occupants[m.From.Resource()]})
+		return
+	}
+	r.emit(RoomEvent{Type: RoomMessage, Message: m,
+		Occupant: r.occupants[m.From.Resource()]})
+}
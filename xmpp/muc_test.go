@@ -0,0 +1,231 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func mucPresence(from JID, typ string, item MucItem,
+	codes ...int) *Presence {
+
+	p := &Presence{Header: Header{From: from, Type: typ}}
+	x := &MucUser{Items: []MucItem{item}}
+	for _, c := range codes {
+		x.Status = append(x.Status, MucStatus{Code: c})
+	}
+	p.Nested = []interface{}{x}
+	return p
+}
+
+func expectRoomEvent(t *testing.T, r *Room, typ RoomEventType) RoomEvent {
+	select {
+	case ev := <-r.Events:
+		if ev.Type != typ {
+			t.Fatalf("got event %v, expected type %d", ev, typ)
+		}
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no room event")
+	}
+	return RoomEvent{}
+}
+
+// Set up a client with the MUC extension, pinging quiet rooms at the
+// given interval. Stanzas for the extension go on the first channel,
+// and anything else it receives, such as iq replies, on the second.
+func newMucTestClient(t *testing.T, ping time.Duration) (*Muc,
+	chan<- Stanza, chan<- interface{}, <-chan Stanza, <-chan Stanza,
+	func()) {
+
+	cl, recv, sent := newTestClient()
+	cl.Disco = newDisco()
+	m := NewMuc()
+	m.pingInterval = ping
+	m.Init(cl)
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	go m.recvFilter(in, out)
+	return m, in, recv, out, sent, func() {
+		close(in)
+		close(recv)
+	}
+}
+
+type joinResult struct {
+	room *Room
+	err  error
+}
+
+func joinAsync(m *Muc, room JID, nick string,
+	opts *JoinOptions) <-chan joinResult {
+
+	ch := make(chan joinResult, 1)
+	go func() {
+		r, err := m.Join(context.Background(), room, nick, opts)
+		ch <- joinResult{r, err}
+	}()
+	return ch
+}
+
+func TestMucJoin(t *testing.T) {
+	m, in, _, out, sent, done := newMucTestClient(t, time.Hour)
+	defer done()
+
+	zero := 0
+	ch := joinAsync(m, "room@conf.example.com", "bot",
+		&JoinOptions{History: &MucHistory{MaxStanzas: &zero}})
+	p := (<-sent).(*Presence)
+	exp := `<presence to="room@conf.example.com/bot">` +
+		`<x xmlns="http://jabber.org/protocol/muc">` +
+		`<history maxstanzas="0"></history></x></presence>`
+	assertMarshal(t, exp, p)
+
+	in <- mucPresence("room@conf.example.com/alice", "",
+		MucItem{Affiliation: AffiliationMember,
+			Role: RoleParticipant})
+	// The room changes our nick.
+	in <- mucPresence("room@conf.example.com/bot2", "",
+		MucItem{Affiliation: AffiliationNone,
+			Role: RoleParticipant}, MucStatusSelf,
+		MucStatusNickFixed)
+	res := <-ch
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	r := res.room
+	assertEquals(t, "bot2", r.Nick())
+	ev := expectRoomEvent(t, r, OccupantJoined)
+	assertEquals(t, "alice", ev.Occupant.Nick)
+	assertEquals(t, AffiliationMember, ev.Occupant.Affiliation)
+	expectRoomEvent(t, r, OccupantJoined)
+	if len(r.Occupants()) != 2 {
+		t.Errorf("occupants %v", r.Occupants())
+	}
+
+	subj := &Message{Header: Header{From: "room@conf.example.com/alice",
+		Type: "groupchat"}, Subject: []Text{{Chardata: "Plans"}}}
+	in <- subj
+	expectRoomEvent(t, r, RoomSubject)
+	assertEquals(t, "Plans", r.Subject())
+	in <- &Message{Header: Header{From: "room@conf.example.com/alice",
+		Type: "groupchat"}, Body: []Text{{Chardata: "hi"}}}
+	ev = expectRoomEvent(t, r, RoomMessage)
+	assertEquals(t, "alice", ev.Occupant.Nick)
+
+	// Alice becomes Alicia.
+	in <- mucPresence("room@conf.example.com/alice", "unavailable",
+		MucItem{Nick: "alicia"}, MucStatusNewNick)
+	in <- mucPresence("room@conf.example.com/alicia", "",
+		MucItem{Affiliation: AffiliationMember,
+			Role: RoleParticipant})
+	ev = expectRoomEvent(t, r, OccupantNickChanged)
+	assertEquals(t, "alice", ev.OldNick)
+	assertEquals(t, "alicia", ev.Occupant.Nick)
+	if _, ok := r.Occupant("alice"); ok {
+		t.Error("alice still here")
+	}
+
+	in <- mucPresence("room@conf.example.com/alicia", "unavailable",
+		MucItem{Role: RoleNone, Reason: "spam"}, MucStatusKicked)
+	ev = expectRoomEvent(t, r, OccupantLeft)
+	if len(ev.Status) != 1 || ev.Status[0] != MucStatusKicked ||
+		ev.Reason != "spam" {
+		t.Errorf("event %v", ev)
+	}
+
+	// Stanzas from elsewhere pass through.
+	other := NewMessage("you@example.com", MessageChat, "hi")
+	in <- other
+	if st := <-out; st != other {
+		t.Errorf("got %v", st)
+	}
+
+	if err := r.Send(context.Background(), "hello"); err != nil {
+		t.Fatal(err)
+	}
+	msg := (<-sent).(*Message)
+	assertEquals(t, "groupchat", msg.Type)
+	assertEquals(t, "room@conf.example.com", string(msg.To))
+
+	p = mucPresence("room@conf.example.com/bot2", "unavailable",
+		MucItem{Role: RoleNone}, MucStatusSelf)
+	mucUser(p).Destroy = &MucDestroy{Jid: "new@conf.example.com",
+		Reason: "moved"}
+	in <- p
+	ev = expectRoomEvent(t, r, RoomDestroyed)
+	assertEquals(t, "new@conf.example.com", string(ev.Destroy.Jid))
+	if _, ok := <-r.Events; ok {
+		t.Error("events not closed")
+	}
+	if m.Room("room@conf.example.com") != nil {
+		t.Error("room not forgotten")
+	}
+}
+
+func TestMucJoinTimeout(t *testing.T) {
+	m, _, _, _, sent, done := newMucTestClient(t, time.Hour)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	ch := make(chan error, 1)
+	go func() {
+		_, err := m.Join(ctx, "room@conf.example.com", "bot", nil)
+		ch <- err
+	}()
+	<-sent
+	// The room never answers, so we take back our request.
+	p := (<-sent).(*Presence)
+	assertEquals(t, "room@conf.example.com/bot", string(p.To))
+	assertEquals(t, "unavailable", p.Type)
+	if err := <-ch; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wrong error %v", err)
+	}
+	if m.Room("room@conf.example.com") != nil {
+		t.Error("room not forgotten")
+	}
+}
+
+func TestMucNickConflict(t *testing.T) {
+	m, in, _, _, sent, done := newMucTestClient(t, time.Hour)
+	defer done()
+
+	ch := joinAsync(m, "room@conf.example.com", "bot", nil)
+	p := (<-sent).(*Presence)
+	reply := p.ErrorReply(NewError(ErrorConflict, ""))
+	reply.From = p.To
+	in <- reply
+	res := <-ch
+	if !errors.Is(res.err, ErrorConflict) {
+		t.Errorf("wrong error %v", res.err)
+	}
+
+	// Try again with another nick.
+	ch = joinAsync(m, "room@conf.example.com", "bot_", nil)
+	p = (<-sent).(*Presence)
+	assertEquals(t, "room@conf.example.com/bot_", string(p.To))
+	in <- mucPresence(p.To, "", MucItem{Role: RoleParticipant},
+		MucStatusSelf)
+	res = <-ch
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+
+	// Leave.
+	lch := make(chan error)
+	go func() {
+		lch <- res.room.Leave(context.Background(), "bye")
+	}()
+	p = (<-sent).(*Presence)
+	assertEquals(t, "unavailable", p.Type)
+	in <- mucPresence(p.To, "unavailable", MucItem{Role: RoleNone},
+		MucStatusSelf)
+	if err := <-lch; err != nil {
+		t.Error(err)
+	}
+	expectRoomEvent(t, res.room, OccupantJoined)
+	expectRoomEvent(t, res.room, RoomLeft)
+}
@@ -0,0 +1,141 @@
+package xmpp
+
+// This file contains support for administering multi-user chat rooms,
+// XEP-0045 sections 8 to 10.
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+)
+
+const (
+	NsMucAdmin      = "http://jabber.org/protocol/muc#admin"
+	NsMucOwner      = "http://jabber.org/protocol/muc#owner"
+	NsMucRoomConfig = "http://jabber.org/protocol/muc#roomconfig"
+)
+
+// Changes or lists roles and affiliations.
+type MucAdminQuery struct {
+	XMLName xml.Name  `xml:"http://jabber.org/protocol/muc#admin query"`
+	Items   []MucItem `xml:"item"`
+}
+
+// Gets or sets a room's configuration, or destroys it.
+type MucOwnerQuery struct {
+	XMLName xml.Name    `xml:"http://jabber.org/protocol/muc#owner query"`
+	Form    *Form       `xml:"jabber:x:data x"`
+	Destroy *MucDestroy `xml:"destroy"`
+}
+
+// Returns true if joining created the room. A new room is locked,
+// and nobody else can enter it until it's been configured with
+// Configure or CreateInstant.
+func (r *Room) Created() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.created
+}
+
+// Unlock a new room, accepting the server's default configuration.
+func (r *Room) CreateInstant(ctx context.Context) error {
+	return r.Configure(ctx, &Form{Type: FormTypeSubmit})
+}
+
+// Fetch the room's configuration form. Fill it in and pass its Submit
+// to Configure.
+func (r *Room) Config(ctx context.Context) (*Form, error) {
+	reply, err := r.adminIq(ctx, IqGet, &MucOwnerQuery{})
+	if err != nil {
+		return nil, err
+	}
+	for _, ele := range reply.Nested {
+		if q, ok := ele.(*MucOwnerQuery); ok && q.Form != nil {
+			return q.Form, nil
+		}
+	}
+	return nil, fmt.Errorf("no config form from %s", r.Jid)
+}
+
+// Change the room's configuration. The fields are named in
+// muc#roomconfig, XEP-0045 section 15.5.3.
+func (r *Room) Configure(ctx context.Context, form *Form) error {
+	_, err := r.adminIq(ctx, IqSet, &MucOwnerQuery{Form: form})
+	return err
+}
+
+// Destroy the room. Occupants are told about the alternate room, if
+// one is given.
+func (r *Room) Destroy(ctx context.Context, alternate JID,
+	reason string) error {
+
+	_, err := r.adminIq(ctx, IqSet, &MucOwnerQuery{
+		Destroy: &MucDestroy{Jid: alternate, Reason: reason}})
+	return err
+}
+
+// Change a user's affiliation with the room: AffiliationOwner,
+// AffiliationAdmin, AffiliationMember, AffiliationOutcast, or
+// AffiliationNone.
+func (r *Room) SetAffiliation(ctx context.Context, jid JID, affiliation,
+	reason string) error {
+
+	_, err := r.adminIq(ctx, IqSet, &MucAdminQuery{Items: []MucItem{{
+		Jid: jid.Bare(), Affiliation: affiliation, Reason: reason}}})
+	return err
+}
+
+// List the users with the given affiliation.
+func (r *Room) Affiliations(ctx context.Context,
+	affiliation string) ([]MucItem, error) {
+
+	reply, err := r.adminIq(ctx, IqGet, &MucAdminQuery{
+		Items: []MucItem{{Affiliation: affiliation}}})
+	if err != nil {
+		return nil, err
+	}
+	for _, ele := range reply.Nested {
+		if q, ok := ele.(*MucAdminQuery); ok {
+			return q.Items, nil
+		}
+	}
+	return nil, nil
+}
+
+// Change an occupant's role: RoleModerator, RoleParticipant,
+// RoleVisitor, or RoleNone.
+func (r *Room) SetRole(ctx context.Context, nick, role,
+	reason string) error {
+
+	_, err := r.adminIq(ctx, IqSet, &MucAdminQuery{Items: []MucItem{{
+		Nick: nick, Role: role, Reason: reason}}})
+	return err
+}
+
+// Remove an occupant from the room. They may come back.
+func (r *Room) Kick(ctx context.Context, nick, reason string) error {
+	return r.SetRole(ctx, nick, RoleNone, reason)
+}
+
+// Remove a user from the room, and keep them out.
+func (r *Room) Ban(ctx context.Context, jid JID, reason string) error {
+	return r.SetAffiliation(ctx, jid, AffiliationOutcast, reason)
+}
+
+// Let an occupant speak in a moderated room.
+func (r *Room) GrantVoice(ctx context.Context, nick string) error {
+	return r.SetRole(ctx, nick, RoleParticipant, "")
+}
+
+// Stop an occupant speaking in a moderated room.
+func (r *Room) RevokeVoice(ctx context.Context, nick,
+	reason string) error {
+
+	return r.SetRole(ctx, nick, RoleVisitor, reason)
+}
+
+func (r *Room) adminIq(ctx context.Context, typ IqType,
+	query interface{}) (*Iq, error) {
+
+	return r.muc.getClient().SendIq(ctx, NewIq(typ, r.Jid, query))
+}
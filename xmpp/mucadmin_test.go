@@ -0,0 +1,156 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Join a room as "bot", with the room answering with the given
+// status codes.
+func joinTestRoom(t *testing.T, m *Muc, in chan<- Stanza,
+	sent <-chan Stanza, codes ...int) *Room {
+
+	ch := joinAsync(m, "room@conf.example.com", "bot", nil)
+	p := (<-sent).(*Presence)
+	in <- mucPresence(p.To, "", MucItem{Affiliation: AffiliationOwner,
+		Role: RoleModerator}, append(codes, MucStatusSelf)...)
+	res := <-ch
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	expectRoomEvent(t, res.room, OccupantJoined)
+	return res.room
+}
+
+func TestMucConfigure(t *testing.T) {
+	m, in, recv, _, sent, done := newMucTestClient(t, time.Hour)
+	defer done()
+
+	r := joinTestRoom(t, m, in, sent, MucStatusCreated)
+	if !r.Created() {
+		t.Error("not created")
+	}
+
+	ch := make(chan error, 1)
+	go func() { ch <- r.CreateInstant(context.Background()) }()
+	iq := (<-sent).(*Iq)
+	exp := `<iq to="room@conf.example.com" id="` + iq.Id +
+		`" type="set"><query xmlns="` + NsMucOwner + `">` +
+		`<x xmlns="jabber:x:data" type="submit"></x></query></iq>`
+	assertMarshal(t, exp, iq)
+	recv <- iq.Reply()
+	if err := <-ch; err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		form *Form
+		err  error
+	}
+	fch := make(chan result, 1)
+	go func() {
+		f, err := r.Config(context.Background())
+		fch <- result{f, err}
+	}()
+	iq = (<-sent).(*Iq)
+	form := NewForm(FormTypeForm, NsMucRoomConfig)
+	form.Fields = append(form.Fields, FormField{
+		Var: "muc#roomconfig_persistentroom", Type: "boolean",
+		Values: []string{"0"}})
+	recv <- iq.Reply(&MucOwnerQuery{Form: form})
+	res := <-fch
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	sub := res.form.Submit()
+	sub.Set("muc#roomconfig_persistentroom", "1")
+	go func() { ch <- r.Configure(context.Background(), sub) }()
+	iq = (<-sent).(*Iq)
+	q := iq.Nested[0].(*MucOwnerQuery)
+	assertEquals(t, "1", q.Form.Value("muc#roomconfig_persistentroom"))
+	assertEquals(t, NsMucRoomConfig, q.Form.FormType())
+	recv <- iq.ErrorReply(NewError(ErrorForbidden, ""))
+	if err := <-ch; !errors.Is(err, ErrorForbidden) {
+		t.Errorf("wrong error %v", err)
+	}
+}
+
+func TestMucAdmin(t *testing.T) {
+	m, in, recv, _, sent, done := newMucTestClient(t, time.Hour)
+	defer done()
+
+	r := joinTestRoom(t, m, in, sent)
+	if r.Created() {
+		t.Error("created")
+	}
+	ctx := context.Background()
+	tests := []struct {
+		f   func() error
+		exp string
+	}{
+		{func() error { return r.Kick(ctx, "troll", "Begone") },
+			`<item role="none" nick="troll">` +
+				`<reason>Begone</reason></item>`},
+		{func() error {
+			return r.Ban(ctx, "troll@example.com/x", "")
+		},
+			`<item affiliation="outcast"` +
+				` jid="troll@example.com"></item>`},
+		{func() error { return r.GrantVoice(ctx, "alice") },
+			`<item role="participant" nick="alice"></item>`},
+		{func() error { return r.RevokeVoice(ctx, "alice", "") },
+			`<item role="visitor" nick="alice"></item>`},
+		{func() error {
+			return r.SetAffiliation(ctx, "alice@example.com",
+				AffiliationAdmin, "")
+		},
+			`<item affiliation="admin"` +
+				` jid="alice@example.com"></item>`},
+		{func() error {
+			return r.Destroy(ctx, "new@conf.example.com", "Moved")
+		},
+			``},
+	}
+	for _, test := range tests {
+		ch := make(chan error, 1)
+		go func() { ch <- test.f() }()
+		iq := (<-sent).(*Iq)
+		if test.exp != "" {
+			exp := `<iq to="room@conf.example.com" id="` +
+				iq.Id + `" type="set"><query xmlns="` +
+				NsMucAdmin + `">` + test.exp + `</query></iq>`
+			assertMarshal(t, exp, iq)
+		} else {
+			q := iq.Nested[0].(*MucOwnerQuery)
+			if q.Destroy == nil || q.Destroy.Reason != "Moved" {
+				t.Errorf("sent %v", q)
+			}
+		}
+		recv <- iq.Reply()
+		if err := <-ch; err != nil {
+			t.Error(err)
+		}
+	}
+
+	type result struct {
+		items []MucItem
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		items, err := r.Affiliations(ctx, AffiliationMember)
+		ch <- result{items, err}
+	}()
+	iq := (<-sent).(*Iq)
+	assertEquals(t, "get", iq.Type)
+	recv <- iq.Reply(&MucAdminQuery{Items: []MucItem{
+		{Affiliation: AffiliationMember, Jid: "bob@example.com"},
+		{Affiliation: AffiliationMember, Jid: "eve@example.com"}}})
+	res := <-ch
+	if res.err != nil || len(res.items) != 2 ||
+		res.items[1].Jid != "eve@example.com" {
+		t.Errorf("got %v, %v", res.items, res.err)
+	}
+}
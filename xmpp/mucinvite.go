@@ -0,0 +1,170 @@
+package xmpp
+
+// This file contains support for invitations to multi-user chat
+// rooms: direct ones, XEP-0249, and those sent via the room, XEP-0045
+// section 7.8.
+
+import (
+	"context"
+	"encoding/xml"
+	"log"
+)
+
+const NsConference = "jabber:x:conference"
+
+// A direct invitation, sent in a message from the inviter.
+type DirectInvite struct {
+	XMLName  xml.Name `xml:"jabber:x:conference x"`
+	Jid      JID      `xml:"jid,attr"`
+	Password string   `xml:"password,attr,omitempty"`
+	Reason   string   `xml:"reason,attr,omitempty"`
+	// True if the invitation continues a one-to-one chat, in the
+	// given thread.
+	Continue bool   `xml:"continue,attr,omitempty"`
+	Thread   string `xml:"thread,attr,omitempty"`
+}
+
+// An invitation sent via a room, or the refusal of one. In a message
+// from the room, From is the inviter or the invitee who declined; in
+// one to the room, To is who it's for.
+type MucInvite struct {
+	From   JID    `xml:"from,attr,omitempty"`
+	To     JID    `xml:"to,attr,omitempty"`
+	Reason string `xml:"reason,omitempty"`
+}
+
+// An invitation to a room, of either kind.
+type Invitation struct {
+	// The room's bare JID.
+	Room JID
+	// Who invited us, if we know.
+	From     JID
+	Reason   string
+	Password string
+	// True for a direct invitation, false for one sent via the
+	// room.
+	Direct bool
+	// The thread of the chat the invitation continues, if any.
+	Thread string
+}
+
+// Returns the invitation carried in a message, or nil if there isn't
+// one.
+func ParseInvitation(m *Message) *Invitation {
+	for _, ele := range m.Nested {
+		switch x := ele.(type) {
+		case *DirectInvite:
+			inv := &Invitation{Room: x.Jid.Bare(), From: m.From,
+				Reason: x.Reason, Password: x.Password,
+				Direct: true}
+			if x.Continue {
+				inv.Thread = x.Thread
+			}
+			return inv
+		case *MucUser:
+			if len(x.Invite) == 0 {
+				continue
+			}
+			return &Invitation{Room: m.From.Bare(),
+				From:     x.Invite[0].From,
+				Reason:   x.Invite[0].Reason,
+				Password: x.Password}
+		}
+	}
+	return nil
+}
+
+// Invite somebody to the room. The room passes the invitation on,
+// and adds us to the member list first if it's members-only and
+// we're allowed to.
+func (r *Room) Invite(ctx context.Context, to JID, reason string) error {
+	m := NewMessage(r.Jid, MessageNormal, "")
+	m.Nested = []interface{}{&MucUser{Invite: []MucInvite{{To: to,
+		Reason: reason}}}}
+	return r.muc.getClient().send(ctx, m)
+}
+
+// Invite somebody to the room directly, with the password we joined
+// with. This works even if the room won't pass invitations on.
+func (r *Room) InviteDirect(ctx context.Context, to JID,
+	reason string) error {
+
+	r.lock.Lock()
+	password := r.password
+	r.lock.Unlock()
+	m := NewMessage(to, MessageNormal, "")
+	m.Nested = []interface{}{&DirectInvite{Jid: r.Jid,
+		Password: password, Reason: reason}}
+	return r.muc.getClient().send(ctx, m)
+}
+
+// Join the room we've been invited to.
+func (m *Muc) Accept(ctx context.Context, inv *Invitation,
+	nick string) (*Room, error) {
+
+	return m.Join(ctx, inv.Room, nick,
+		&JoinOptions{Password: inv.Password})
+}
+
+// Tell whoever invited us via a room that we won't be joining. Direct
+// invitations can't be declined, so for those this does nothing.
+func (m *Muc) Decline(ctx context.Context, inv *Invitation,
+	reason string) error {
+
+	if inv.Direct {
+		return nil
+	}
+	msg := NewMessage(inv.Room, MessageNormal, "")
+	msg.Nested = []interface{}{&MucUser{Decline: &MucInvite{
+		To: inv.From, Reason: reason}}}
+	return m.getClient().send(ctx, msg)
+}
+
+// Accept direct invitations from anybody in the roster, joining with
+// the given nick. This is meant for bots. If rooms isn't nil, each room
+// joined this way is sent on it. The messages carrying invitations
+// are still delivered on Client.Recv.
+func (m *Muc) AutoAccept(nick string, rooms chan<- *Room) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.autoNick = nick
+	m.autoRooms = rooms
+}
+
+// Join the room if the invitation is from a contact.
+func (m *Muc) autoAccept(cl *Client, inv *Invitation, nick string,
+	rooms chan<- *Room) {
+
+	if m.Room(inv.Room) != nil || !cl.inRoster(inv.From) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		mucJoinTimeout)
+	defer cancel()
+	r, err := m.Accept(ctx, inv, nick)
+	if err != nil {
+		if Debug {
+			log.Printf("Accepting invitation to %s: %v",
+				inv.Room, err)
+		}
+		return
+	}
+	if rooms != nil {
+		select {
+		case rooms <- r:
+		case <-cl.done:
+		}
+	}
+}
+
+func (cl *Client) inRoster(jid JID) bool {
+	if jid == "" {
+		return false
+	}
+	for _, item := range cl.Roster.snapshot() {
+		if sameJid(item.Jid, jid.Bare()) {
+			return true
+		}
+	}
+	return false
+}
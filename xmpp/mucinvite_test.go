@@ -0,0 +1,168 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestParseInvitation(t *testing.T) {
+	types := NewMuc().StanzaTypes
+	parse := func(str string) *Invitation {
+		msg := &Message{}
+		if err := xml.Unmarshal([]byte(str), msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := parseExtended(&msg.Header, types); err != nil {
+			t.Fatal(err)
+		}
+		return ParseInvitation(msg)
+	}
+
+	inv := parse(`<message xmlns="jabber:client"` +
+		` from="friend@example.com/a">` +
+		`<x xmlns="jabber:x:conference" jid="room@conf.example.com"` +
+		` password="secret" reason="Come along" continue="true"` +
+		` thread="t1"/></message>`)
+	if inv == nil {
+		t.Fatal("no direct invitation")
+	}
+	exp := Invitation{Room: "room@conf.example.com",
+		From: "friend@example.com/a", Reason: "Come along",
+		Password: "secret", Direct: true, Thread: "t1"}
+	if *inv != exp {
+		t.Errorf("got %+v", *inv)
+	}
+
+	inv = parse(`<message xmlns="jabber:client"` +
+		` from="room@conf.example.com">` +
+		`<x xmlns="` + NsMucUser + `">` +
+		`<invite from="friend@example.com/a"><reason>Hi</reason>` +
+		`</invite><password>secret</password></x></message>`)
+	if inv == nil {
+		t.Fatal("no mediated invitation")
+	}
+	exp = Invitation{Room: "room@conf.example.com",
+		From: "friend@example.com/a", Reason: "Hi",
+		Password: "secret"}
+	if *inv != exp {
+		t.Errorf("got %+v", *inv)
+	}
+
+	if inv = parse(`<message xmlns="jabber:client"` +
+		` from="friend@example.com/a">` +
+		`<body>hi</body></message>`); inv != nil {
+		t.Errorf("got %+v", *inv)
+	}
+}
+
+func TestMucInvite(t *testing.T) {
+	m, in, _, _, sent, done := newMucTestClient(t, time.Hour)
+	defer done()
+	ch := joinAsync(m, "room@conf.example.com", "bot",
+		&JoinOptions{Password: "secret"})
+	p := (<-sent).(*Presence)
+	in <- mucPresence(p.To, "", MucItem{Role: RoleParticipant},
+		MucStatusSelf)
+	res := <-ch
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	r := res.room
+	expectRoomEvent(t, r, OccupantJoined)
+	ctx := context.Background()
+
+	if err := r.Invite(ctx, "you@example.com", "Hi"); err != nil {
+		t.Fatal(err)
+	}
+	exp := `<message xmlns="jabber:client"` +
+		` to="room@conf.example.com" type="normal">` +
+		`<x xmlns="` + NsMucUser + `"><invite to="you@example.com">` +
+		`<reason>Hi</reason></invite></x></message>`
+	assertMarshal(t, exp, <-sent)
+
+	if err := r.InviteDirect(ctx, "you@example.com", ""); err != nil {
+		t.Fatal(err)
+	}
+	exp = `<message xmlns="jabber:client"` +
+		` to="you@example.com" type="normal">` +
+		`<x xmlns="jabber:x:conference" jid="room@conf.example.com"` +
+		` password="secret"></x></message>`
+	assertMarshal(t, exp, <-sent)
+
+	msg := &Message{Header: Header{From: "room@conf.example.com"}}
+	msg.Nested = []interface{}{&MucUser{Decline: &MucInvite{
+		From: "you@example.com", Reason: "Busy"}}}
+	in <- msg
+	ev := expectRoomEvent(t, r, InviteDeclined)
+	assertEquals(t, "you@example.com", string(ev.Invitee))
+	assertEquals(t, "Busy", ev.Reason)
+
+	// We decline an invitation to somewhere else.
+	inv := &Invitation{Room: "other@conf.example.com",
+		From: "you@example.com/a"}
+	if err := m.Decline(ctx, inv, "No"); err != nil {
+		t.Fatal(err)
+	}
+	exp = `<message xmlns="jabber:client"` +
+		` to="other@conf.example.com" type="normal">` +
+		`<x xmlns="` + NsMucUser + `"><decline to="you@example.com/a">` +
+		`<reason>No</reason></decline></x></message>`
+	assertMarshal(t, exp, <-sent)
+}
+
+func TestMucAutoAccept(t *testing.T) {
+	m, in, recv, out, sent, done := newMucTestClient(t, time.Hour)
+	defer done()
+	cl := m.client
+	roster := newRosterExt()
+	roster.client = cl
+	cl.Roster = *roster
+	roster.Init(cl)
+	roster.update()
+	iq := (<-sent).(*Iq)
+	recv <- iq.Reply(&RosterQuery{Item: []RosterItem{
+		{Jid: "friend@example.com", Subscription: "both"}}})
+	roster.Get()
+
+	rooms := make(chan *Room)
+	m.AutoAccept("bot", rooms)
+	invite := func(from JID) {
+		msg := &Message{Header: Header{From: from}}
+		msg.Nested = []interface{}{&DirectInvite{
+			Jid: "room@conf.example.com", Password: "secret"}}
+		in <- msg
+		// It's passed on either way.
+		if st := <-out; st != msg {
+			t.Errorf("got %v", st)
+		}
+	}
+
+	invite("stranger@example.com/a")
+
+	// Anybody can claim a contact asked a room to invite us.
+	forged := &Message{Header: Header{From: "trap@evil.example.com"}}
+	forged.Nested = []interface{}{&MucUser{Invite: []MucInvite{
+		{From: "friend@example.com/a"}}}}
+	in <- forged
+	<-out
+
+	invite("friend@example.com/a")
+	p := (<-sent).(*Presence)
+	assertEquals(t, "room@conf.example.com/bot", string(p.To))
+	assertEquals(t, "secret", p.Nested[0].(*MucJoin).Password)
+	in <- mucPresence(p.To, "", MucItem{Role: RoleParticipant},
+		MucStatusSelf)
+	select {
+	case r := <-rooms:
+		assertEquals(t, "room@conf.example.com", string(r.Jid))
+	case <-time.After(time.Second):
+		t.Fatal("room not joined")
+	}
+	select {
+	case st := <-sent:
+		t.Errorf("sent %v", st)
+	default:
+	}
+}
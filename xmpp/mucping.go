@@ -0,0 +1,178 @@
+package xmpp
+
+// This file contains MUC self-pings, XEP-0410, and rejoining rooms
+// we've dropped out of.
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	// How long a room can be quiet before we check we're still in
+	// it.
+	mucPingInterval = 5 * time.Minute
+	// How long to wait for the answer to a self-ping.
+	mucPingTimeout = time.Minute
+	// How long to wait for a room to let us in, when it's not
+	// the application asking.
+	mucJoinTimeout = time.Minute
+)
+
+// Watch over the rooms for as long as the client runs: rejoin rooms
+// lost by an earlier client or session once this one is running, and
+// ping rooms that have gone quiet.
+func (m *Muc) watch(cl *Client, status <-chan Status) {
+	tick := time.NewTicker(m.pingInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case s, ok := <-status:
+			switch {
+			case !ok || s.Fatal():
+				status = nil
+			case s == StatusRedirected:
+				// The new host doesn't know we were
+				// in the rooms.
+				m.disconnect(cl)
+			case s == StatusRunning:
+				m.rejoinLost(cl)
+			}
+		case <-tick.C:
+			m.pingQuiet(cl)
+			m.rejoinLost(cl)
+		case <-cl.done:
+			m.disconnect(cl)
+			return
+		}
+	}
+}
+
+func (m *Muc) allRooms() []*Room {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	rooms := make([]*Room, 0, len(m.rooms))
+	for _, r := range m.rooms {
+		rooms = append(rooms, r)
+	}
+	return rooms
+}
+
+// The client or its session is gone, so we're no longer in the rooms
+// it joined.
+func (m *Muc) disconnect(cl *Client) {
+	for _, r := range m.allRooms() {
+		r.lock.Lock()
+		if r.client == cl && r.joined {
+			r.loseLocked()
+		}
+		r.lock.Unlock()
+	}
+}
+
+func (m *Muc) rejoinLost(cl *Client) {
+	for _, r := range m.allRooms() {
+		r.lock.Lock()
+		lost := r.lost && !r.rejoining && !r.closed
+		if lost {
+			r.rejoining = true
+		}
+		r.lock.Unlock()
+		if lost {
+			go r.rejoin(cl)
+		}
+	}
+}
+
+func (m *Muc) pingQuiet(cl *Client) {
+	for _, r := range m.allRooms() {
+		r.lock.Lock()
+		quiet := r.joined && !r.pinging &&
+			time.Since(r.lastSeen) >= m.pingInterval
+		if quiet {
+			r.pinging = true
+		}
+		r.lock.Unlock()
+		if quiet {
+			go r.selfPing(cl)
+		}
+	}
+}
+
+// Ping our own occupant JID, which the room only passes on if we're
+// still in it. XEP-0410, section 3.
+func (r *Room) selfPing(cl *Client) {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		mucPingTimeout)
+	defer cancel()
+	err := cl.Ping(ctx, r.occupantJid(r.Nick()))
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.pinging = false
+	var xerr *Error
+	switch {
+	case err == nil, errors.Is(err, ErrorServiceUnavailable),
+		errors.Is(err, ErrorFeatureNotImplemented),
+		errors.Is(err, ErrorItemNotFound):
+		// Still there, though item-not-found means our nick
+		// changed under us.
+		r.lastSeen = time.Now()
+	case errors.As(err, &xerr) &&
+		!errors.Is(err, ErrorRemoteServerNotFound) &&
+		!errors.Is(err, ErrorRemoteServerTimeout):
+		if r.joined && r.client == cl {
+			r.loseLocked()
+		}
+	default:
+		// The room or its server may be unreachable for now.
+		// We'll ask again next time.
+		if Debug {
+			log.Printf("Self-ping in %s: %v", r.Jid, err)
+		}
+	}
+}
+
+// We've dropped out of the room. The caller holds r.lock.
+func (r *Room) loseLocked() {
+	r.joined = false
+	r.lost = true
+	r.lostAt = time.Now()
+	r.occupants = make(map[string]Occupant)
+	r.renamed = make(map[string]string)
+	r.emit(RoomEvent{Type: RoomDisconnected})
+}
+
+// Try to get back into a room with the nick and password we last
+// used, asking for whatever we missed. If the room won't have us,
+// give up on it.
+func (r *Room) rejoin(cl *Client) {
+	r.lock.Lock()
+	nick, password := r.nick, r.password
+	history := &MucHistory{Since: r.lostAt.UTC().Format(
+		"2006-01-02T15:04:05Z")}
+	r.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		mucJoinTimeout)
+	defer cancel()
+	err := r.join(ctx, cl, nick, password, history)
+
+	var xerr *Error
+	giveUp := errors.As(err, &xerr) && xerr.Type != ErrorTypeWait
+	r.lock.Lock()
+	r.rejoining = false
+	if giveUp {
+		r.emit(RoomEvent{Type: RoomLeft, Reason: err.Error()})
+	}
+	r.lock.Unlock()
+	if giveUp {
+		r.close()
+	} else if err != nil {
+		// We'll try again later.
+		if Debug {
+			log.Printf("Rejoining %s: %v", r.Jid, err)
+		}
+	}
+}
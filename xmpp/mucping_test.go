@@ -0,0 +1,143 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMucSelfPing(t *testing.T) {
+	m, in, recv, _, sent, done := newMucTestClient(t,
+		20*time.Millisecond)
+	defer done()
+	r := joinTestRoom(t, m, in, sent)
+
+	// The room is quiet, so we ping ourselves. A client that
+	// doesn't understand pings is still there.
+	iq := (<-sent).(*Iq)
+	exp := `<iq to="room@conf.example.com/bot" id="` + iq.Id +
+		`" type="get"><ping xmlns="urn:xmpp:ping"></ping></iq>`
+	assertMarshal(t, exp, iq)
+	recv <- iq.ErrorReply(NewError(ErrorServiceUnavailable, ""))
+
+	// We're still there under another nick.
+	iq = (<-sent).(*Iq)
+	recv <- iq.ErrorReply(NewError(ErrorItemNotFound, ""))
+
+	// We can't tell whether we're there when the room's server
+	// can't be reached.
+	iq = (<-sent).(*Iq)
+	recv <- iq.ErrorReply(NewError(ErrorRemoteServerTimeout, ""))
+	iq = (<-sent).(*Iq)
+	select {
+	case ev := <-r.Events:
+		t.Fatalf("event %v", ev)
+	default:
+	}
+
+	// Any other error means the room has forgotten us.
+	recv <- iq.ErrorReply(NewError(ErrorBadRequest, ""))
+	expectRoomEvent(t, r, RoomDisconnected)
+	if len(r.Occupants()) != 0 {
+		t.Errorf("occupants %v", r.Occupants())
+	}
+
+	p := (<-sent).(*Presence)
+	assertEquals(t, "room@conf.example.com/bot", string(p.To))
+	join := p.Nested[0].(*MucJoin)
+	if join.History == nil || join.History.Since == "" {
+		t.Errorf("history %v", join.History)
+	}
+	in <- mucPresence(p.To, "", MucItem{Role: RoleParticipant},
+		MucStatusSelf)
+	expectRoomEvent(t, r, OccupantJoined)
+	expectRoomEvent(t, r, RoomRejoined)
+}
+
+func TestMucRedirect(t *testing.T) {
+	m, in, _, _, sent, done := newMucTestClient(t, time.Hour)
+	defer done()
+	r := joinTestRoom(t, m, in, sent)
+
+	// The new host doesn't know we're in the room, so we join
+	// again once the session there is running.
+	cl := m.getClient()
+	cl.setStatus(StatusRedirected)
+	expectRoomEvent(t, r, RoomDisconnected)
+	cl.setStatus(StatusRunning)
+	p := (<-sent).(*Presence)
+	assertEquals(t, "room@conf.example.com/bot", string(p.To))
+	in <- mucPresence(p.To, "", MucItem{Role: RoleParticipant},
+		MucStatusSelf)
+	expectRoomEvent(t, r, OccupantJoined)
+	expectRoomEvent(t, r, RoomRejoined)
+}
+
+func TestMucRejoin(t *testing.T) {
+	cl, recv, sent := newTestClient()
+	cl.Disco = newDisco()
+	m := NewMuc()
+	m.Init(cl)
+	in := make(chan Stanza)
+	go m.recvFilter(in, make(chan Stanza))
+	ch := joinAsync(m, "room@conf.example.com", "bot",
+		&JoinOptions{Password: "secret"})
+	p := (<-sent).(*Presence)
+	in <- mucPresence(p.To, "", MucItem{Role: RoleParticipant},
+		MucStatusSelf)
+	res := <-ch
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	r := res.room
+	expectRoomEvent(t, r, OccupantJoined)
+
+	// The connection drops.
+	close(in)
+	close(recv)
+	expectRoomEvent(t, r, RoomDisconnected)
+
+	// Nothing happens until the new client is running.
+	cl, recv, sent = newTestClient()
+	defer close(recv)
+	cl.Disco = newDisco()
+	m.Init(cl)
+	in = make(chan Stanza)
+	defer close(in)
+	go m.recvFilter(in, make(chan Stanza))
+	cl.setStatus(StatusRunning)
+	p = (<-sent).(*Presence)
+	assertEquals(t, "room@conf.example.com/bot", string(p.To))
+	assertEquals(t, "secret", p.Nested[0].(*MucJoin).Password)
+
+	// The room won't have us back.
+	reply := &Presence{Header: Header{From: p.To,
+		Type:  string(PresenceError),
+		Error: NewError(ErrorRegistrationRequired, "")}}
+	in <- reply
+	ev := expectRoomEvent(t, r, RoomLeft)
+	if ev.Reason == "" {
+		t.Error("no reason")
+	}
+	if _, ok := <-r.Events; ok {
+		t.Error("events not closed")
+	}
+	if m.Room(r.Jid) != nil {
+		t.Error("room not forgotten")
+	}
+}
+
+func TestPing(t *testing.T) {
+	cl, recv, sent := newTestClient()
+	defer close(recv)
+	ch := make(chan error, 1)
+	go func() {
+		ch <- cl.Ping(context.Background(), "example.com")
+	}()
+	iq := (<-sent).(*Iq)
+	recv <- iq.ErrorReply(NewError(ErrorFeatureNotImplemented, ""))
+	if err := <-ch; !errors.Is(err, ErrorFeatureNotImplemented) {
+		t.Errorf("wrong error %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package xmpp
+
+// This file contains support for the personal eventing protocol,
+// XEP-0163: pubsub nodes belonging to each account.
+
+import (
+	"context"
+)
+
+// Appended to a node's namespace to make the disco feature which asks
+// contacts to send us its notifications. XEP-0163, section 4.
+const pepNotify = "+notify"
+
+// Some well-known PEP nodes, each named after the namespace of its
+// payload.
+const (
+	// User nickname, XEP-0172.
+	NsNick = "http://jabber.org/protocol/nick"
+	// User avatar, XEP-0084.
+	NsAvatarData     = "urn:xmpp:avatar:data"
+	NsAvatarMetadata = "urn:xmpp:avatar:metadata"
+	// User location, XEP-0080.
+	NsGeoloc = "http://jabber.org/protocol/geoloc"
+)
+
+// Called with each notification from a PEP node. From is the contact
+// the node belongs to.
+type PepHandler func(n PubSubNotification)
+
+// Register a handler for notifications from the node with the given
+// namespace, and tell contacts we're interested in it. This replaces
+// any handler previously registered for the node; a nil handler
+// removes it. Handlers are called one at a time, in the order the
+// notifications arrive. Contacts learn of the change through our
+// entity capabilities, so if this is called after our initial
+// presence, send presence again.
+func (ps *PubSub) HandlePep(node string, h PepHandler) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if h == nil {
+		delete(ps.pepHandlers, node)
+		if ps.client != nil {
+			ps.client.Disco.RemoveFeature(node + pepNotify)
+		}
+		return
+	}
+	ps.pepHandlers[node] = h
+	if ps.client != nil {
+		ps.client.Disco.AddFeature(node + pepNotify)
+	}
+}
+
+func (ps *PubSub) pepHandler(node string) PepHandler {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	return ps.pepHandlers[node]
+}
+
+// Is this the bare JID of an account, which PEP nodes belong to?
+func isAccount(jid JID) bool {
+	return jid.Node() != "" && jid.Resource() == ""
+}
+
+// Pass notifications to their handlers.
+func (ps *PubSub) dispatchPep(in <-chan PubSubNotification) {
+	for n := range in {
+		// The handler may have been removed since the
+		// notification was queued, in which case the
+		// application gets it like any other.
+		if h := ps.pepHandler(n.Node); h != nil {
+			h(n)
+		} else {
+			ps.queue <- n
+		}
+	}
+}
+
+// Publish an item to one of our own PEP nodes, creating the node if
+// necessary. Contacts who have told us they're interested in the node
+// are notified.
+func (ps *PubSub) PublishPep(ctx context.Context, node, id string,
+	payload interface{}) (string, error) {
+
+	return ps.Publish(ctx, "", node, id, payload)
+}
+
+// Fetch the items in a contact's PEP node.
+func (ps *PubSub) PepItems(ctx context.Context, jid JID,
+	node string) ([]PubSubItem, error) {
+
+	items, _, err := ps.Items(ctx, jid.Bare(), node, nil)
+	return items, err
+}
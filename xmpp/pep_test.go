@@ -0,0 +1,131 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+type testNick struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/nick nick"`
+	Nick    string   `xml:",chardata"`
+}
+
+func TestPepHandlers(t *testing.T) {
+	cl, recv, _ := newTestClient()
+	defer close(recv)
+	cl.Disco = newDisco()
+	cl.Disco.Init(cl)
+
+	ps := NewPubSub()
+	nicks := make(chan PubSubNotification, 1)
+	ps.HandlePep(NsNick, func(n PubSubNotification) { nicks <- n })
+	ps.Init(cl)
+	if !cl.Disco.LocalInfo().HasFeature(NsNick + "+notify") {
+		t.Error("no interest in nicks")
+	}
+	ver, _ := CapsVer(capsHash, cl.Disco.LocalInfo())
+	ps.HandlePep(NsGeoloc, func(n PubSubNotification) {})
+	if !cl.Disco.LocalInfo().HasFeature(NsGeoloc + "+notify") {
+		t.Error("no interest in locations")
+	}
+	if v, _ := CapsVer(capsHash, cl.Disco.LocalInfo()); v == ver {
+		t.Error("caps unchanged")
+	}
+	ps.HandlePep(NsGeoloc, nil)
+	if cl.Disco.LocalInfo().HasFeature(NsGeoloc + "+notify") {
+		t.Error("still interested in locations")
+	}
+
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	go ps.recvFilter(in, out)
+	defer close(in)
+	notify := func(from JID, node, payload string) {
+		m := &Message{Header: Header{From: from}}
+		m.Nested = []interface{}{&PubSubEvent{Items: &PubSubItems{
+			Node: node, Items: []PubSubItem{{Id: "current",
+				Payload: payload}}}}}
+		in <- m
+	}
+	notify("friend@example.com", NsNick,
+		`<nick xmlns="`+NsNick+`">Buddy</nick>`)
+	notify("friend@example.com", "urn:example:other",
+		`<x xmlns="urn:example:other"/>`)
+
+	select {
+	case n := <-nicks:
+		assertEquals(t, "friend@example.com", string(n.From))
+		var nick testNick
+		if err := n.Items[0].Decode(&nick); err != nil {
+			t.Fatal(err)
+		}
+		assertEquals(t, "Buddy", nick.Nick)
+	case <-time.After(time.Second):
+		t.Fatal("nick not handled")
+	}
+	n := <-ps.Notifications
+	assertEquals(t, "urn:example:other", n.Node)
+
+	// A pubsub service's node isn't a PEP node, whatever it's
+	// called.
+	notify("pubsub.example.com", NsNick,
+		`<nick xmlns="`+NsNick+`">Service</nick>`)
+	n = <-ps.Notifications
+	assertEquals(t, "pubsub.example.com", string(n.From))
+
+	// Notifications still queued when a handler is removed aren't
+	// lost.
+	handled := make(chan bool)
+	ps.HandlePep(NsGeoloc, func(n PubSubNotification) {
+		handled <- true
+		<-handled
+	})
+	geoloc := `<geoloc xmlns="` + NsGeoloc + `"/>`
+	notify("friend@example.com", NsGeoloc, geoloc)
+	<-handled
+	notify("friend@example.com", NsGeoloc, geoloc)
+	// Once this is through, the last one's been queued.
+	notify("friend@example.com", "urn:example:other", "")
+	<-ps.Notifications
+	ps.HandlePep(NsGeoloc, nil)
+	handled <- true
+	select {
+	case n = <-ps.Notifications:
+		assertEquals(t, NsGeoloc, n.Node)
+	case <-time.After(time.Second):
+		t.Fatal("notification lost")
+	}
+}
+
+func TestPublishPep(t *testing.T) {
+	cl, recv, sent := newTestClient()
+	defer close(recv)
+	ps := NewPubSub()
+	ps.Init(cl)
+
+	type result struct {
+		id  string
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		id, err := ps.PublishPep(context.Background(), NsNick, "",
+			&testNick{Nick: "Me"})
+		ch <- result{id, err}
+	}()
+	iq := (<-sent).(*Iq)
+	exp := `<iq id="` + iq.Id + `" type="set"><pubsub xmlns="` +
+		NsPubSub + `"><publish node="` + NsNick + `"><item>` +
+		`<nick xmlns="` + NsNick + `">Me</nick></item></publish>` +
+		`</pubsub></iq>`
+	assertMarshal(t, exp, iq)
+	// Our server answers for our account.
+	reply := iq.Reply()
+	reply.From = "me@example.com"
+	recv <- reply
+	if res := <-ch; res.err != nil {
+		t.Error(res.err)
+	}
+}
@@ -0,0 +1,170 @@
+// Certificate pinning and trust-on-first-use, for servers whose
+// certificates can't be verified against a CA.
+
+package xmpp
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A TrustStore remembers which server keys have been accepted for
+// each domain. It's used by CertPinner's trust-on-first-use mode.
+type TrustStore interface {
+	// Returns the fingerprints previously recorded for the
+	// domain. An unknown domain isn't an error.
+	Get(domain string) ([]string, error)
+	// Records a fingerprint as trusted for the domain.
+	Put(domain, fingerprint string) error
+}
+
+// CertPinner checks the server's public key against a set of known
+// fingerprints. Install its VerifyConnection method as the
+// VerifyConnection field of the tls.Config given to NewClient. If the
+// config's InsecureSkipVerify is false, the usual certificate
+// verification happens first and pinning is an additional check;
+// otherwise the pins are the only check, which is appropriate for
+// self-signed certificates.
+type CertPinner struct {
+	// Fingerprints, as computed by SpkiFingerprint, of acceptable
+	// keys. The server's own key may match, or, if the chain was
+	// verified, a CA key in it. The rest of what the server sends
+	// proves nothing, since anybody can send a public certificate.
+	// If this is non-empty, Store is not consulted.
+	Pins []string
+	// If non-nil, the first key seen for a domain is recorded
+	// here, and later connections must present the same key.
+	Store TrustStore
+}
+
+// Returned when the server presents a key we don't trust.
+type PinMismatchError struct {
+	Domain string
+	// Fingerprint of the server's key.
+	Fingerprint string
+	// The fingerprints which would have been accepted.
+	Expected []string
+}
+
+var _ error = &PinMismatchError{}
+
+// FileTrustStore is a TrustStore kept in a text file, with one
+// domain and fingerprint per line.
+type FileTrustStore struct {
+	Path string
+	lock sync.Mutex
+}
+
+var _ TrustStore = &FileTrustStore{}
+
+// Returns the fingerprint of the certificate's public key, in the
+// form "sha256/" followed by the base64 encoding of the SHA-256 hash
+// of the SubjectPublicKeyInfo.
+func SpkiFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Suitable for use as tls.Config.VerifyConnection.
+func (p *CertPinner) VerifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("no certificate from %s", cs.ServerName)
+	}
+	leaf := SpkiFingerprint(cs.PeerCertificates[0])
+	if len(p.Pins) > 0 {
+		if p.pinned(leaf) {
+			return nil
+		}
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain {
+				if p.pinned(SpkiFingerprint(cert)) {
+					return nil
+				}
+			}
+		}
+		return &PinMismatchError{Domain: cs.ServerName,
+			Fingerprint: leaf, Expected: p.Pins}
+	}
+	if p.Store == nil {
+		return nil
+	}
+	known, err := p.Store.Get(cs.ServerName)
+	if err != nil {
+		return err
+	}
+	if len(known) == 0 {
+		return p.Store.Put(cs.ServerName, leaf)
+	}
+	for _, fp := range known {
+		if fp == leaf {
+			return nil
+		}
+	}
+	return &PinMismatchError{Domain: cs.ServerName, Fingerprint: leaf,
+		Expected: known}
+}
+
+func (p *CertPinner) pinned(fp string) bool {
+	for _, pin := range p.Pins {
+		if fp == pin {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *PinMismatchError) Error() string {
+	return fmt.Sprintf("untrusted key %s for %s", e.Fingerprint,
+		e.Domain)
+}
+
+func (s *FileTrustStore) Get(domain string) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f, err := os.Open(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var fps []string
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		fields := strings.Fields(scan.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if strings.EqualFold(fields[0], domain) {
+			fps = append(fps, fields[1])
+		}
+	}
+	return fps, scan.Err()
+}
+
+func (s *FileTrustStore) Put(domain, fingerprint string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s %s\n", strings.ToLower(domain),
+		fingerprint)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestPins(t *testing.T) {
+	good := makeCert(t)
+	bad := makeCert(t)
+	p := &CertPinner{Pins: []string{SpkiFingerprint(good)}}
+
+	cs := tls.ConnectionState{ServerName: "example.com",
+		PeerCertificates: []*x509.Certificate{good}}
+	if err := p.VerifyConnection(cs); err != nil {
+		t.Error(err)
+	}
+	// Anybody can send the pinned certificate after their own.
+	cs.PeerCertificates = []*x509.Certificate{bad, good}
+	if err := p.VerifyConnection(cs); err == nil {
+		t.Error("unpinned leaf accepted")
+	}
+	// But a pinned CA in a verified chain is good enough.
+	cs.VerifiedChains = [][]*x509.Certificate{{bad, good}}
+	if err := p.VerifyConnection(cs); err != nil {
+		t.Error(err)
+	}
+
+	cs = tls.ConnectionState{ServerName: "example.com",
+		PeerCertificates: []*x509.Certificate{bad}}
+	err := p.VerifyConnection(cs)
+	var pe *PinMismatchError
+	if !errors.As(err, &pe) {
+		t.Fatalf("wrong error %v", err)
+	}
+	assertEquals(t, "example.com", pe.Domain)
+	assertEquals(t, SpkiFingerprint(bad), pe.Fingerprint)
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	store := &FileTrustStore{Path: filepath.Join(t.TempDir(), "known")}
+	p := &CertPinner{Store: store}
+	first := makeCert(t)
+	other := makeCert(t)
+
+	cs := tls.ConnectionState{ServerName: "Example.com",
+		PeerCertificates: []*x509.Certificate{first}}
+	if err := p.VerifyConnection(cs); err != nil {
+		t.Fatal(err)
+	}
+	fps, err := store.Get("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fps) != 1 || fps[0] != SpkiFingerprint(first) {
+		t.Fatalf("stored %v", fps)
+	}
+
+	// Same key again is fine; a new one isn't.
+	if err := p.VerifyConnection(cs); err != nil {
+		t.Error(err)
+	}
+	cs.PeerCertificates = []*x509.Certificate{other}
+	var pe *PinMismatchError
+	if err := p.VerifyConnection(cs); !errors.As(err, &pe) {
+		t.Errorf("wrong error %v", err)
+	}
+
+	// Other domains are independent.
+	cs.ServerName = "example.org"
+	if err := p.VerifyConnection(cs); err != nil {
+		t.Error(err)
+	}
+}
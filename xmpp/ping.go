@@ -0,0 +1,22 @@
+package xmpp
+
+// This file contains support for XMPP ping, XEP-0199.
+
+import (
+	"context"
+	"encoding/xml"
+)
+
+const NsPing = "urn:xmpp:ping"
+
+type Ping struct {
+	XMLName xml.Name `xml:"urn:xmpp:ping ping"`
+}
+
+// Ping an entity, and wait for its reply. An entity which doesn't
+// understand pings replies with ErrorServiceUnavailable or
+// ErrorFeatureNotImplemented, which is still a sign of life.
+func (cl *Client) Ping(ctx context.Context, to JID) error {
+	_, err := cl.SendIq(ctx, NewIq(IqGet, to, &Ping{}))
+	return err
+}
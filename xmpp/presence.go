@@ -0,0 +1,326 @@
+package xmpp
+
+// This file contains a tracker for our contacts' presence, RFC 6121,
+// section 4.
+
+import (
+	"sort"
+	"time"
+)
+
+// PresenceTracker keeps track of which resources of each contact are
+// available, based on the presence stanzas we receive. Include its
+// Extension in the list given to NewClient. Presence stanzas are
+// still delivered to Client.Recv.
+type PresenceTracker struct {
+	Extension
+	updates     chan *Presence
+	get         chan presenceGet
+	subscribe   chan presenceSub
+	unsubscribe chan (<-chan PresenceEvent)
+	client      *Client
+}
+
+// What we know about one available resource.
+type ResourcePresence struct {
+	// The resource's full JID.
+	Jid      JID
+	Show     PresenceShow
+	Status   string
+	Priority int
+	// When we last heard from the resource.
+	Updated time.Time
+}
+
+// Describes a resource becoming available, changing its presence, or
+// going offline.
+type PresenceEvent struct {
+	Resource ResourcePresence
+	// False if the resource has gone offline.
+	Available bool
+}
+
+// A subscriber's events go in to a queue, and come out where the
+// subscriber reads them.
+type presenceSub struct {
+	in   chan<- PresenceEvent
+	out  <-chan PresenceEvent
+	stop chan struct{}
+}
+
+type presenceGet struct {
+	// The bare JID to look up, or "" for everybody.
+	jid   JID
+	reply chan map[JID][]ResourcePresence
+}
+
+// Creates a presence tracker.
+func NewPresenceTracker() *PresenceTracker {
+	pt := &PresenceTracker{}
+	pt.updates = make(chan *Presence)
+	pt.get = make(chan presenceGet)
+	pt.subscribe = make(chan presenceSub)
+	pt.unsubscribe = make(chan (<-chan PresenceEvent))
+	pt.RecvFilter = pt.recvFilter
+	pt.Init = func(cl *Client) {
+		pt.client = cl
+		go pt.presenceMgr(cl.done, cl.statmgr.newQueuedListener())
+	}
+	return pt
+}
+
+// Note each presence stanza on its way to the application.
+func (pt *PresenceTracker) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for st := range in {
+		if p, ok := st.(*Presence); ok {
+			select {
+			case pt.updates <- p:
+			case <-pt.client.done:
+			}
+		}
+		out <- st
+	}
+}
+
+func (pt *PresenceTracker) presenceMgr(done <-chan struct{},
+	status <-chan Status) {
+
+	// Bare JID to resource to presence.
+	contacts := make(map[JID]map[string]ResourcePresence)
+	var subs []presenceSub
+	var events []PresenceEvent
+	defer func() {
+		for _, ev := range forgetPresence(contacts, nil) {
+			for _, sub := range subs {
+				sub.in <- ev
+			}
+		}
+		for _, sub := range subs {
+			close(sub.in)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+
+		case s, ok := <-status:
+			if !ok {
+				status = nil
+				continue
+			}
+			if s != StatusRedirected {
+				continue
+			}
+			// Presence from the old session won't be
+			// followed by unavailable presence on the new
+			// one.
+			events = forgetPresence(contacts, events)
+
+		case req := <-pt.get:
+			res := make(map[JID][]ResourcePresence)
+			for bare, rs := range contacts {
+				if req.jid != "" && bare != req.jid {
+					continue
+				}
+				res[bare] = sortResources(rs)
+			}
+			req.reply <- res
+			continue
+
+		case sub := <-pt.subscribe:
+			// Catch the new subscriber up.
+			subs = append(subs, sub)
+			for _, rs := range contacts {
+				for _, rp := range rs {
+					sub.in <- PresenceEvent{Resource: rp,
+						Available: true}
+				}
+			}
+			continue
+
+		case unsub := <-pt.unsubscribe:
+			for i, sub := range subs {
+				if sub.out == unsub {
+					close(sub.stop)
+					subs = append(subs[:i], subs[i+1:]...)
+					break
+				}
+			}
+			continue
+
+		case p := <-pt.updates:
+			events = applyPresence(contacts, p, events)
+		}
+		for _, ev := range events {
+			for _, sub := range subs {
+				sub.in <- ev
+			}
+		}
+		events = events[:0]
+	}
+}
+
+// Everybody's offline as far as we know. Forget them, and add an
+// event for each of their resources to events.
+func forgetPresence(contacts map[JID]map[string]ResourcePresence,
+	events []PresenceEvent) []PresenceEvent {
+
+	for bare, rs := range contacts {
+		for _, rp := range rs {
+			events = append(events, PresenceEvent{Resource: rp})
+		}
+		delete(contacts, bare)
+	}
+	return events
+}
+
+// Update the contacts from a presence stanza, and add events
+// describing what changed to events.
+func applyPresence(contacts map[JID]map[string]ResourcePresence,
+	p *Presence, events []PresenceEvent) []PresenceEvent {
+
+	bare := p.From.Bare()
+	switch PresenceType(p.Type) {
+	case PresenceAvailable:
+		rp := resourcePresence(p)
+		rs := contacts[bare]
+		if rs == nil {
+			rs = make(map[string]ResourcePresence)
+			contacts[bare] = rs
+		}
+		rs[p.From.Resource()] = rp
+		return append(events, PresenceEvent{Resource: rp,
+			Available: true})
+
+	case PresenceUnavailable:
+		rs := contacts[bare]
+		res := p.From.Resource()
+		if res == "" {
+			// The whole contact is gone.
+			for _, rp := range rs {
+				events = append(events,
+					PresenceEvent{Resource: rp})
+			}
+			delete(contacts, bare)
+			return events
+		}
+		if rp, ok := rs[res]; ok {
+			events = append(events, PresenceEvent{Resource: rp})
+			delete(rs, res)
+			if len(rs) == 0 {
+				delete(contacts, bare)
+			}
+		}
+
+	case PresenceError:
+		// The contact can't be reached. RFC 6121, section
+		// 4.3.2.
+		for _, rp := range contacts[bare] {
+			events = append(events, PresenceEvent{Resource: rp})
+		}
+		delete(contacts, bare)
+	}
+	return events
+}
+
+func resourcePresence(p *Presence) ResourcePresence {
+	rp := ResourcePresence{Jid: p.From, Show: p.GetShow(),
+		Priority: p.GetPriority(), Updated: time.Now()}
+	if len(p.Status) > 0 {
+		rp.Status = p.Status[0].Chardata
+	}
+	return rp
+}
+
+// How available each show value means a resource is, from least to
+// most.
+var showRank = map[PresenceShow]int{
+	ShowDnd:       0,
+	ShowXa:        1,
+	ShowAway:      2,
+	ShowAvailable: 3,
+	ShowChat:      4,
+}
+
+// Return the resources, best first: highest priority, then most
+// available, then most recently heard from.
+func sortResources(rs map[string]ResourcePresence) []ResourcePresence {
+	list := make([]ResourcePresence, 0, len(rs))
+	for _, rp := range rs {
+		list = append(list, rp)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if showRank[a.Show] != showRank[b.Show] {
+			return showRank[a.Show] > showRank[b.Show]
+		}
+		return a.Updated.After(b.Updated)
+	})
+	return list
+}
+
+func (pt *PresenceTracker) query(jid JID) map[JID][]ResourcePresence {
+	req := presenceGet{jid: jid,
+		reply: make(chan map[JID][]ResourcePresence, 1)}
+	select {
+	case pt.get <- req:
+		return <-req.reply
+	case <-pt.client.done:
+		return nil
+	}
+}
+
+// Returns the available resources of a contact, best first. The
+// result is empty if the contact is offline.
+func (pt *PresenceTracker) Resources(jid JID) []ResourcePresence {
+	return pt.query(jid.Bare())[jid.Bare()]
+}
+
+// Returns the contact's best resource: the one with the highest
+// priority, or if there's a tie, the most available one. If the
+// contact is offline, ok is false.
+func (pt *PresenceTracker) Best(jid JID) (rp ResourcePresence, ok bool) {
+	rs := pt.Resources(jid)
+	if len(rs) == 0 {
+		return rp, false
+	}
+	return rs[0], true
+}
+
+// Returns the available resources of every contact who's online,
+// keyed by bare JID, best first.
+func (pt *PresenceTracker) Snapshot() map[JID][]ResourcePresence {
+	return pt.query("")
+}
+
+// Returns a channel on which presence changes will be delivered,
+// starting with an event for each resource that's already
+// available. When the client shuts down, every resource is reported
+// as having gone offline, and the channel is closed. Events wait in a
+// queue until they're read, so a slow subscriber doesn't hold up the
+// tracker.
+func (pt *PresenceTracker) Subscribe() <-chan PresenceEvent {
+	in := make(chan PresenceEvent)
+	out := make(chan PresenceEvent)
+	sub := presenceSub{in: in, out: out, stop: make(chan struct{})}
+	go queue(in, out, sub.stop)
+	select {
+	case pt.subscribe <- sub:
+	case <-pt.client.done:
+		close(in)
+	}
+	return out
+}
+
+// Stop delivering events on a channel returned by Subscribe.
+func (pt *PresenceTracker) Unsubscribe(ch <-chan PresenceEvent) {
+	select {
+	case pt.unsubscribe <- ch:
+	case <-pt.client.done:
+	}
+}
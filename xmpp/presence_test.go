@@ -0,0 +1,124 @@
+package xmpp
+
+import (
+	"testing"
+	"time"
+)
+
+func availPresence(from JID, show string, prio string) *Presence {
+	p := &Presence{Header: Header{From: from}}
+	if show != "" {
+		p.Show = &Data{Chardata: show}
+	}
+	if prio != "" {
+		p.Priority = &Data{Chardata: prio}
+	}
+	return p
+}
+
+func expectPresenceEvent(t *testing.T, ch <-chan PresenceEvent, jid JID,
+	avail bool) {
+
+	select {
+	case ev := <-ch:
+		if ev.Resource.Jid != jid || ev.Available != avail {
+			t.Errorf("got %v, expected %s %v", ev, jid, avail)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no presence event")
+	}
+}
+
+func TestPresenceTracker(t *testing.T) {
+	cl := &Client{Jid: "me@example.com/res"}
+	cl.done = make(chan struct{})
+	cl.statmgr = newStatmgr(nil)
+	pt := NewPresenceTracker()
+	pt.Init(cl)
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	go pt.recvFilter(in, out)
+	events := pt.Subscribe()
+	deliver := func(st Stanza) {
+		in <- st
+		if got := <-out; got != st {
+			t.Fatalf("got %v", got)
+		}
+	}
+
+	deliver(availPresence("you@example.com/phone", "away", "5"))
+	expectPresenceEvent(t, events, "you@example.com/phone", true)
+	deliver(availPresence("you@example.com/desk", "", "5"))
+	expectPresenceEvent(t, events, "you@example.com/desk", true)
+	deliver(availPresence("you@example.com/bot", "chat", "-1"))
+	expectPresenceEvent(t, events, "you@example.com/bot", true)
+
+	rs := pt.Resources("you@example.com/whatever")
+	if len(rs) != 3 {
+		t.Fatalf("resources %v", rs)
+	}
+	assertEquals(t, "you@example.com/desk", string(rs[0].Jid))
+	assertEquals(t, "you@example.com/phone", string(rs[1].Jid))
+	assertEquals(t, "you@example.com/bot", string(rs[2].Jid))
+	if rs[1].Show != "away" || rs[1].Priority != 5 {
+		t.Errorf("phone %v", rs[1])
+	}
+
+	deliver(&Presence{Header: Header{From: "you@example.com/desk",
+		Type: "unavailable"}})
+	expectPresenceEvent(t, events, "you@example.com/desk", false)
+	if best, ok := pt.Best("you@example.com"); !ok ||
+		best.Jid != "you@example.com/phone" {
+		t.Errorf("best %v", best)
+	}
+	if _, ok := pt.Best("nobody@example.com"); ok {
+		t.Error("nobody is online")
+	}
+
+	deliver(&Presence{Header: Header{From: "you@example.com",
+		Type: "error"}})
+	gone := make(map[JID]bool)
+	for i := 0; i < 2; i++ {
+		if ev := <-events; !ev.Available {
+			gone[ev.Resource.Jid] = true
+		}
+	}
+	if !gone["you@example.com/phone"] || !gone["you@example.com/bot"] {
+		t.Errorf("gone %v", gone)
+	}
+	if snap := pt.Snapshot(); len(snap) != 0 {
+		t.Errorf("snapshot %v", snap)
+	}
+
+	// A subscriber that has stopped reading doesn't hold anybody
+	// up.
+	idle := pt.Subscribe()
+	for i := 0; i < 200; i++ {
+		deliver(availPresence("them@example.com/a", "", ""))
+		expectPresenceEvent(t, events, "them@example.com/a", true)
+	}
+	pt.Unsubscribe(idle)
+	for range idle {
+	}
+	stuck := pt.Subscribe()
+	defer pt.Unsubscribe(stuck)
+
+	// On another host, we won't hear that they went away.
+	cl.setStatus(StatusRedirected)
+	expectPresenceEvent(t, events, "them@example.com/a", false)
+	if snap := pt.Snapshot(); len(snap) != 0 {
+		t.Errorf("snapshot after redirect %v", snap)
+	}
+
+	// Disconnecting takes everybody offline.
+	deliver(availPresence("them@example.com/a", "", ""))
+	expectPresenceEvent(t, events, "them@example.com/a", true)
+	close(cl.done)
+	expectPresenceEvent(t, events, "them@example.com/a", false)
+	if _, ok := <-events; ok {
+		t.Error("events not closed")
+	}
+	if snap := pt.Snapshot(); snap != nil {
+		t.Errorf("snapshot after shutdown %v", snap)
+	}
+}
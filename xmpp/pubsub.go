@@ -0,0 +1,406 @@
+package xmpp
+
+// This file contains support for publish-subscribe, XEP-0060.
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+const (
+	NsPubSub           = "http://jabber.org/protocol/pubsub"
+	NsPubSubEvent      = "http://jabber.org/protocol/pubsub#event"
+	NsPubSubOwner      = "http://jabber.org/protocol/pubsub#owner"
+	NsPubSubNodeConfig = "http://jabber.org/protocol/pubsub#node_config"
+)
+
+// Values for PubSubSubscription.Subscription.
+const (
+	PubSubSubscribed   = "subscribed"
+	PubSubPending      = "pending"
+	PubSubUnconfigured = "unconfigured"
+	PubSubNone         = "none"
+)
+
+// A pubsub request or result. Each request uses one of the fields.
+type PubSubQuery struct {
+	XMLName      xml.Name            `xml:"http://jabber.org/protocol/pubsub pubsub"`
+	Create       *PubSubNode         `xml:"create"`
+	Configure    *PubSubConfigure    `xml:"configure"`
+	Publish      *PubSubItems        `xml:"publish"`
+	Retract      *PubSubRetract      `xml:"retract"`
+	Subscribe    *PubSubSubscription `xml:"subscribe"`
+	Unsubscribe  *PubSubSubscription `xml:"unsubscribe"`
+	Subscription *PubSubSubscription `xml:"subscription"`
+	Items        *PubSubItems        `xml:"items"`
+	Set          *RsmSet             `xml:"http://jabber.org/protocol/rsm set"`
+}
+
+// A request only a node's owner may make.
+type PubSubOwnerQuery struct {
+	XMLName   xml.Name         `xml:"http://jabber.org/protocol/pubsub#owner pubsub"`
+	Configure *PubSubConfigure `xml:"configure"`
+	Delete    *PubSubNode      `xml:"delete"`
+}
+
+type PubSubNode struct {
+	Node string `xml:"node,attr,omitempty"`
+}
+
+// A node's configuration, as a data form of type
+// NsPubSubNodeConfig.
+type PubSubConfigure struct {
+	Node string `xml:"node,attr,omitempty"`
+	Form *Form  `xml:"jabber:x:data x"`
+}
+
+// Some of a node's items.
+type PubSubItems struct {
+	Node string `xml:"node,attr,omitempty"`
+	// When fetching items, the most recent ones to return.
+	MaxItems int          `xml:"max_items,attr,omitempty"`
+	Items    []PubSubItem `xml:"item"`
+	// In a notification, items which have been removed.
+	Retracted []PubSubItem `xml:"retract"`
+}
+
+type PubSubItem struct {
+	Id string `xml:"id,attr,omitempty"`
+	// Who published the item, if the service says.
+	Publisher JID `xml:"publisher,attr,omitempty"`
+	// The item's content, as XML.
+	Payload string `xml:",innerxml"`
+}
+
+type PubSubRetract struct {
+	Node   string       `xml:"node,attr"`
+	Notify bool         `xml:"notify,attr,omitempty"`
+	Items  []PubSubItem `xml:"item"`
+}
+
+// A subscription to a node, or a request to make or end one.
+type PubSubSubscription struct {
+	Node  string `xml:"node,attr,omitempty"`
+	Jid   JID    `xml:"jid,attr"`
+	SubId string `xml:"subid,attr,omitempty"`
+	// One of the PubSubSubscribed constants.
+	Subscription string `xml:"subscription,attr,omitempty"`
+}
+
+// The notification element in messages from a pubsub service.
+type PubSubEvent struct {
+	XMLName       xml.Name         `xml:"http://jabber.org/protocol/pubsub#event event"`
+	Items         *PubSubItems     `xml:"items"`
+	Delete        *PubSubNode      `xml:"delete"`
+	Purge         *PubSubNode      `xml:"purge"`
+	Configuration *PubSubConfigure `xml:"configuration"`
+}
+
+// PubSub talks to publish-subscribe services. Include its Extension
+// in the list given to NewClient. Notifications from the nodes we're
+// subscribed to are delivered on Notifications, not on Client.Recv,
+// unless they're for a PEP handler.
+type PubSub struct {
+	Extension
+	// Notifications from nodes. They're queued until they're read.
+	// This is never closed, so the PubSub can go on to serve later
+	// clients.
+	Notifications <-chan PubSubNotification
+	queue         chan PubSubNotification
+	lock          sync.Mutex
+	// Keyed by node.
+	pepHandlers map[string]PepHandler
+	client      *Client
+}
+
+// Something happened to a node.
+type PubSubNotification struct {
+	// The service, or for PEP the account, the node belongs to.
+	From JID
+	Node string
+	// Items which were published, with their payloads if the node
+	// delivers them.
+	Items []PubSubItem
+	// The ids of items which were removed.
+	Retracted []string
+	// The node was deleted, or all its items were.
+	Deleted bool
+	Purged  bool
+	// The node's new configuration, if it was changed and the
+	// service says how.
+	Config *Form
+	// The message the notification came in.
+	Message *Message
+}
+
+// Creates the publish-subscribe extension.
+func NewPubSub() *PubSub {
+	ps := &PubSub{}
+	ps.StanzaTypes = make(map[xml.Name]reflect.Type)
+	ps.StanzaTypes[xml.Name{Space: NsPubSub, Local: "pubsub"}] =
+		reflect.TypeOf(PubSubQuery{})
+	ps.StanzaTypes[xml.Name{Space: NsPubSubOwner, Local: "pubsub"}] =
+		reflect.TypeOf(PubSubOwnerQuery{})
+	ps.StanzaTypes[xml.Name{Space: NsPubSubEvent, Local: "event"}] =
+		reflect.TypeOf(PubSubEvent{})
+	ps.queue = make(chan PubSubNotification)
+	notifications := make(chan PubSubNotification)
+	ps.Notifications = notifications
+	go queue(ps.queue, notifications, nil)
+	ps.pepHandlers = make(map[string]PepHandler)
+	ps.RecvFilter = ps.recvFilter
+	ps.Init = func(cl *Client) {
+		ps.lock.Lock()
+		defer ps.lock.Unlock()
+		ps.client = cl
+		for node := range ps.pepHandlers {
+			cl.Disco.AddFeature(node + pepNotify)
+		}
+	}
+	return ps
+}
+
+// Take notifications out of the incoming stream. Each client gets
+// its own queue for the PEP handlers, which drains once the client
+// is done.
+func (ps *PubSub) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	pepQueue := make(chan PubSubNotification)
+	defer close(pepQueue)
+	pep := make(chan PubSubNotification)
+	go queue(pepQueue, pep, nil)
+	go ps.dispatchPep(pep)
+	for st := range in {
+		m, ok := st.(*Message)
+		if !ok || MessageType(m.Type) == MessageError {
+			out <- st
+			continue
+		}
+		ev := pubSubEvent(m)
+		if ev == nil {
+			out <- st
+			continue
+		}
+		n := newNotification(m, ev)
+		// PEP nodes belong to accounts, so ordinary services
+		// can't reach the PEP handlers.
+		if isAccount(n.From) && ps.pepHandler(n.Node) != nil {
+			pepQueue <- n
+		} else {
+			ps.queue <- n
+		}
+	}
+}
+
+func pubSubEvent(m *Message) *PubSubEvent {
+	for _, ele := range m.Nested {
+		if ev, ok := ele.(*PubSubEvent); ok {
+			return ev
+		}
+	}
+	return nil
+}
+
+func newNotification(m *Message, ev *PubSubEvent) PubSubNotification {
+	n := PubSubNotification{From: m.From, Message: m}
+	switch {
+	case ev.Items != nil:
+		n.Node = ev.Items.Node
+		n.Items = ev.Items.Items
+		for _, item := range ev.Items.Retracted {
+			n.Retracted = append(n.Retracted, item.Id)
+		}
+	case ev.Delete != nil:
+		n.Node = ev.Delete.Node
+		n.Deleted = true
+	case ev.Purge != nil:
+		n.Node = ev.Purge.Node
+		n.Purged = true
+	case ev.Configuration != nil:
+		n.Node = ev.Configuration.Node
+		n.Config = ev.Configuration.Form
+	}
+	return n
+}
+
+// Create a node. If node is empty, the service picks a name for it.
+// If config is nil, the node gets the service's default
+// configuration. Returns the node's name.
+func (ps *PubSub) CreateNode(ctx context.Context, service JID,
+	node string, config *Form) (string, error) {
+
+	q := &PubSubQuery{Create: &PubSubNode{Node: node}}
+	if config != nil {
+		q.Configure = &PubSubConfigure{Form: config}
+	}
+	reply, err := ps.client.SendIq(ctx, NewIq(IqSet, service, q))
+	if err != nil {
+		return "", err
+	}
+	if q := pubSubQuery(reply); q != nil && q.Create != nil &&
+		q.Create.Node != "" {
+		return q.Create.Node, nil
+	}
+	return node, nil
+}
+
+// Fetch a node's configuration form. Fill it in and pass its Submit
+// to ConfigureNode.
+func (ps *PubSub) NodeConfig(ctx context.Context, service JID,
+	node string) (*Form, error) {
+
+	reply, err := ps.client.SendIq(ctx, NewIq(IqGet, service,
+		&PubSubOwnerQuery{Configure: &PubSubConfigure{Node: node}}))
+	if err != nil {
+		return nil, err
+	}
+	for _, ele := range reply.Nested {
+		if q, ok := ele.(*PubSubOwnerQuery); ok && q.Configure != nil &&
+			q.Configure.Form != nil {
+			return q.Configure.Form, nil
+		}
+	}
+	return nil, fmt.Errorf("no config form for %s from %s", node,
+		service)
+}
+
+// Change a node's configuration.
+func (ps *PubSub) ConfigureNode(ctx context.Context, service JID,
+	node string, config *Form) error {
+
+	_, err := ps.client.SendIq(ctx, NewIq(IqSet, service,
+		&PubSubOwnerQuery{Configure: &PubSubConfigure{Node: node,
+			Form: config}}))
+	return err
+}
+
+// Delete a node and all its items.
+func (ps *PubSub) DeleteNode(ctx context.Context, service JID,
+	node string) error {
+
+	_, err := ps.client.SendIq(ctx, NewIq(IqSet, service,
+		&PubSubOwnerQuery{Delete: &PubSubNode{Node: node}}))
+	return err
+}
+
+// Publish an item to a node. The payload is marshaled as XML. If id
+// is empty, the service picks one. Returns the item's id.
+func (ps *PubSub) Publish(ctx context.Context, service JID, node,
+	id string, payload interface{}) (string, error) {
+
+	item, err := newPubSubItem(id, payload)
+	if err != nil {
+		return "", err
+	}
+	reply, err := ps.client.SendIq(ctx, NewIq(IqSet, service,
+		&PubSubQuery{Publish: &PubSubItems{Node: node,
+			Items: []PubSubItem{item}}}))
+	if err != nil {
+		return "", err
+	}
+	if q := pubSubQuery(reply); q != nil && q.Publish != nil &&
+		len(q.Publish.Items) > 0 && q.Publish.Items[0].Id != "" {
+		return q.Publish.Items[0].Id, nil
+	}
+	return id, nil
+}
+
+func newPubSubItem(id string, payload interface{}) (PubSubItem, error) {
+	item := PubSubItem{Id: id}
+	if payload != nil {
+		buf, err := xml.Marshal(payload)
+		if err != nil {
+			return item, err
+		}
+		item.Payload = string(buf)
+	}
+	return item, nil
+}
+
+// Remove an item from a node. If notify is true, subscribers are told
+// it's gone.
+func (ps *PubSub) Retract(ctx context.Context, service JID, node,
+	id string, notify bool) error {
+
+	_, err := ps.client.SendIq(ctx, NewIq(IqSet, service,
+		&PubSubQuery{Retract: &PubSubRetract{Node: node,
+			Notify: notify, Items: []PubSubItem{{Id: id}}}}))
+	return err
+}
+
+// Subscribe our bare JID to a node. The subscription may be pending
+// until the node's owner approves it, or unconfigured until we fill in
+// its options.
+func (ps *PubSub) Subscribe(ctx context.Context, service JID,
+	node string) (*PubSubSubscription, error) {
+
+	reply, err := ps.client.SendIq(ctx, NewIq(IqSet, service,
+		&PubSubQuery{Subscribe: &PubSubSubscription{Node: node,
+			Jid: ps.client.Jid.Bare()}}))
+	if err != nil {
+		return nil, err
+	}
+	if q := pubSubQuery(reply); q != nil && q.Subscription != nil {
+		return q.Subscription, nil
+	}
+	// The service is allowed to say nothing more.
+	return &PubSubSubscription{Node: node, Jid: ps.client.Jid.Bare(),
+		Subscription: PubSubSubscribed}, nil
+}
+
+// End a subscription. SubId is only needed if we're subscribed to the
+// node more than once.
+func (ps *PubSub) Unsubscribe(ctx context.Context, service JID, node,
+	subId string) error {
+
+	_, err := ps.client.SendIq(ctx, NewIq(IqSet, service,
+		&PubSubQuery{Unsubscribe: &PubSubSubscription{Node: node,
+			Jid: ps.client.Jid.Bare(), SubId: subId}}))
+	return err
+}
+
+// Fetch a node's items. If page is nil, the service decides how many
+// to send; otherwise it says which page to get, and the page returned
+// is described by the returned RsmSet, which may be nil if the service
+// doesn't do paging. Use its Next method to ask for the following
+// page.
+func (ps *PubSub) Items(ctx context.Context, service JID, node string,
+	page *RsmSet) ([]PubSubItem, *RsmSet, error) {
+
+	reply, err := ps.client.SendIq(ctx, NewIq(IqGet, service,
+		&PubSubQuery{Items: &PubSubItems{Node: node}, Set: page}))
+	if err != nil {
+		return nil, nil, err
+	}
+	q := pubSubQuery(reply)
+	if q == nil || q.Items == nil {
+		return nil, nil, fmt.Errorf("no items for %s from %s", node,
+			service)
+	}
+	if q.Set != nil {
+		q.Set.size = len(q.Items.Items)
+	}
+	return q.Items.Items, q.Set, nil
+}
+
+func pubSubQuery(iq *Iq) *PubSubQuery {
+	for _, ele := range iq.Nested {
+		if q, ok := ele.(*PubSubQuery); ok {
+			return q
+		}
+	}
+	return nil
+}
+
+// Returns the name of the item's payload element.
+func (item *PubSubItem) PayloadName() xml.Name {
+	return firstElement(item.Payload)
+}
+
+// Unmarshal the item's payload into v.
+func (item *PubSubItem) Decode(v interface{}) error {
+	return xml.Unmarshal([]byte(item.Payload), v)
+}
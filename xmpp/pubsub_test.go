@@ -0,0 +1,272 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"testing"
+	"time"
+)
+
+type testEntry struct {
+	XMLName xml.Name `xml:"urn:example:entry entry"`
+	Title   string   `xml:"title"`
+}
+
+func TestPubSubNotifications(t *testing.T) {
+	ps := NewPubSub()
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	go ps.recvFilter(in, out)
+
+	parse := func(str string) *Message {
+		msg := &Message{}
+		if err := xml.Unmarshal([]byte(str), msg); err != nil {
+			t.Fatal(err)
+		}
+		err := parseExtended(&msg.Header, ps.StanzaTypes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	in <- parse(`<message xmlns="jabber:client"` +
+		` from="pubsub.example.com"><event xmlns="` + NsPubSubEvent +
+		`"><items node="news"><item id="1" publisher="me@example.com">` +
+		`<entry xmlns="urn:example:entry"><title>Hello</title></entry>` +
+		`</item><retract id="0"/></items></event></message>`)
+	in <- parse(`<message xmlns="jabber:client"` +
+		` from="pubsub.example.com"><event xmlns="` + NsPubSubEvent +
+		`"><delete node="news"/></event></message>`)
+	chat := NewMessage("me@example.com", MessageChat, "hi")
+	in <- chat
+	if st := <-out; st != chat {
+		t.Errorf("got %v", st)
+	}
+	close(in)
+
+	n := <-ps.Notifications
+	assertEquals(t, "pubsub.example.com", string(n.From))
+	assertEquals(t, "news", n.Node)
+	if len(n.Items) != 1 || len(n.Retracted) != 1 ||
+		n.Retracted[0] != "0" {
+		t.Fatalf("notification %+v", n)
+	}
+	item := n.Items[0]
+	assertEquals(t, "me@example.com", string(item.Publisher))
+	assertEquals(t, "urn:example:entry", item.PayloadName().Space)
+	var entry testEntry
+	if err := item.Decode(&entry); err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, "Hello", entry.Title)
+
+	n = <-ps.Notifications
+	if !n.Deleted || n.Node != "news" {
+		t.Errorf("notification %+v", n)
+	}
+
+	// The next client can use the same PubSub, PEP handlers and
+	// all.
+	nicks := make(chan PubSubNotification, 1)
+	ps.HandlePep(NsNick, func(n PubSubNotification) { nicks <- n })
+	in = make(chan Stanza)
+	go ps.recvFilter(in, make(chan Stanza))
+	defer close(in)
+	in <- parse(`<message xmlns="jabber:client"` +
+		` from="friend@example.com"><event xmlns="` + NsPubSubEvent +
+		`"><items node="` + NsNick + `"><item id="current"/>` +
+		`</items></event></message>`)
+	in <- parse(`<message xmlns="jabber:client"` +
+		` from="pubsub.example.com"><event xmlns="` + NsPubSubEvent +
+		`"><purge node="news"/></event></message>`)
+	select {
+	case n = <-nicks:
+		assertEquals(t, "friend@example.com", string(n.From))
+	case <-time.After(time.Second):
+		t.Fatal("nick not handled")
+	}
+	if n = <-ps.Notifications; !n.Purged {
+		t.Errorf("notification %+v", n)
+	}
+}
+
+func TestPubSubPublish(t *testing.T) {
+	cl, recv, sent := newTestClient()
+	defer close(recv)
+	ps := NewPubSub()
+	ps.Init(cl)
+	ctx := context.Background()
+	const service = "pubsub.example.com"
+
+	type result struct {
+		s   string
+		err error
+	}
+	ch := make(chan result, 1)
+	config := NewForm(FormTypeSubmit, NsPubSubNodeConfig)
+	config.Set("pubsub#max_items", "10")
+	go func() {
+		node, err := ps.CreateNode(ctx, service, "", config)
+		ch <- result{node, err}
+	}()
+	iq := (<-sent).(*Iq)
+	q := iq.Nested[0].(*PubSubQuery)
+	if q.Create == nil || q.Create.Node != "" || q.Configure == nil ||
+		q.Configure.Form.Value("pubsub#max_items") != "10" {
+		t.Errorf("sent %v", iq)
+	}
+	recv <- iq.Reply(&PubSubQuery{Create: &PubSubNode{Node: "n1"}})
+	if res := <-ch; res.err != nil || res.s != "n1" {
+		t.Errorf("got %v", res)
+	}
+
+	go func() {
+		id, err := ps.Publish(ctx, service, "n1", "",
+			&testEntry{Title: "Hi"})
+		ch <- result{id, err}
+	}()
+	iq = (<-sent).(*Iq)
+	exp := `<iq to="pubsub.example.com" id="` + iq.Id + `" type="set">` +
+		`<pubsub xmlns="` + NsPubSub + `"><publish node="n1"><item>` +
+		`<entry xmlns="urn:example:entry"><title>Hi</title></entry>` +
+		`</item></publish></pubsub></iq>`
+	assertMarshal(t, exp, iq)
+	recv <- iq.Reply(&PubSubQuery{Publish: &PubSubItems{Node: "n1",
+		Items: []PubSubItem{{Id: "abc"}}}})
+	if res := <-ch; res.err != nil || res.s != "abc" {
+		t.Errorf("got %v", res)
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- ps.Retract(ctx, service, "n1", "abc", true) }()
+	iq = (<-sent).(*Iq)
+	exp = `<iq to="pubsub.example.com" id="` + iq.Id + `" type="set">` +
+		`<pubsub xmlns="` + NsPubSub + `"><retract node="n1"` +
+		` notify="true"><item id="abc"></item></retract></pubsub></iq>`
+	assertMarshal(t, exp, iq)
+	recv <- iq.ErrorReply(NewError(ErrorItemNotFound, ""))
+	if err := <-errCh; !errors.Is(err, ErrorItemNotFound) {
+		t.Errorf("wrong error %v", err)
+	}
+
+	go func() { errCh <- ps.DeleteNode(ctx, service, "n1") }()
+	iq = (<-sent).(*Iq)
+	exp = `<iq to="pubsub.example.com" id="` + iq.Id + `" type="set">` +
+		`<pubsub xmlns="` + NsPubSubOwner + `"><delete node="n1">` +
+		`</delete></pubsub></iq>`
+	assertMarshal(t, exp, iq)
+	recv <- iq.Reply()
+	if err := <-errCh; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPubSubSubscribe(t *testing.T) {
+	cl, recv, sent := newTestClient()
+	defer close(recv)
+	ps := NewPubSub()
+	ps.Init(cl)
+	ctx := context.Background()
+	const service = "pubsub.example.com"
+
+	type result struct {
+		sub *PubSubSubscription
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		sub, err := ps.Subscribe(ctx, service, "news")
+		ch <- result{sub, err}
+	}()
+	iq := (<-sent).(*Iq)
+	exp := `<iq to="pubsub.example.com" id="` + iq.Id + `" type="set">` +
+		`<pubsub xmlns="` + NsPubSub + `"><subscribe node="news"` +
+		` jid="me@example.com"></subscribe></pubsub></iq>`
+	assertMarshal(t, exp, iq)
+	recv <- iq.Reply(&PubSubQuery{Subscription: &PubSubSubscription{
+		Node: "news", Jid: "me@example.com", SubId: "s1",
+		Subscription: PubSubPending}})
+	res := <-ch
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	assertEquals(t, PubSubPending, res.sub.Subscription)
+	assertEquals(t, "s1", res.sub.SubId)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- ps.Unsubscribe(ctx, service, "news", "s1") }()
+	iq = (<-sent).(*Iq)
+	q := iq.Nested[0].(*PubSubQuery)
+	if q.Unsubscribe == nil || q.Unsubscribe.SubId != "s1" {
+		t.Errorf("sent %v", iq)
+	}
+	recv <- iq.Reply()
+	if err := <-errCh; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPubSubItems(t *testing.T) {
+	cl, recv, sent := newTestClient()
+	defer close(recv)
+	ps := NewPubSub()
+	ps.Init(cl)
+	ctx := context.Background()
+
+	type result struct {
+		items []PubSubItem
+		page  *RsmSet
+		err   error
+	}
+	fetch := func(page *RsmSet) <-chan result {
+		ch := make(chan result, 1)
+		go func() {
+			items, page, err := ps.Items(ctx, "pubsub.example.com",
+				"news", page)
+			ch <- result{items, page, err}
+		}()
+		return ch
+	}
+
+	ch := fetch(NewRsmSet(2))
+	iq := (<-sent).(*Iq)
+	exp := `<iq to="pubsub.example.com" id="` + iq.Id + `" type="get">` +
+		`<pubsub xmlns="` + NsPubSub + `"><items node="news"></items>` +
+		`<set xmlns="` + NsRsm + `"><max>2</max></set></pubsub></iq>`
+	assertMarshal(t, exp, iq)
+	count, first := 3, 0
+	recv <- iq.Reply(&PubSubQuery{
+		Items: &PubSubItems{Node: "news",
+			Items: []PubSubItem{{Id: "a"}, {Id: "b"}}},
+		Set: &RsmSet{First: &RsmFirst{Index: &first, Id: "a"},
+			Last: "b", Count: &count}})
+	res := <-ch
+	if res.err != nil || len(res.items) != 2 || res.page == nil {
+		t.Fatalf("got %v", res)
+	}
+
+	ch = fetch(res.page.Next(2))
+	iq = (<-sent).(*Iq)
+	q := iq.Nested[0].(*PubSubQuery)
+	if q.Set == nil || q.Set.After != "b" || *q.Set.Max != 2 {
+		t.Errorf("sent %v", iq)
+	}
+	first = 2
+	recv <- iq.Reply(&PubSubQuery{
+		Items: &PubSubItems{Node: "news",
+			Items: []PubSubItem{{Id: "c"}}},
+		Set: &RsmSet{First: &RsmFirst{Index: &first, Id: "c"},
+			Last: "c", Count: &count}})
+	res = <-ch
+	if res.err != nil || len(res.items) != 1 || res.items[0].Id != "c" {
+		t.Fatalf("got %v", res)
+	}
+	if next := res.page.Next(2); next != nil {
+		t.Errorf("next page after the last one: %v", next)
+	}
+
+	if next := (&RsmSet{Count: &count}).Next(2); next != nil {
+		t.Errorf("next page after empty one: %v", next)
+	}
+}
@@ -0,0 +1,33 @@
+// Unbounded queues between the goroutines which produce events and
+// the applications which consume them.
+
+package xmpp
+
+// Pass values from in to out in order, holding as many as necessary
+// so whoever sends on in never waits for whoever reads out. Once in
+// is closed, out is closed when everything has been delivered; once
+// stop is closed, straight away. Stop may be nil.
+func queue[T any](in <-chan T, out chan<- T, stop <-chan struct{}) {
+	defer close(out)
+	var pending []T
+	for in != nil || len(pending) > 0 {
+		var send chan<- T
+		var next T
+		if len(pending) > 0 {
+			send = out
+			next = pending[0]
+		}
+		select {
+		case v, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			pending = append(pending, v)
+		case send <- next:
+			pending = pending[1:]
+		case <-stop:
+			return
+		}
+	}
+}
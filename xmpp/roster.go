@@ -1,105 +1,285 @@
 package xmpp
 
-// This file contains support for roster management, RFC 3921, Section 7.
+// This file contains support for roster management, RFC 6121, Section 2.
 
 import (
+	"context"
 	"encoding/xml"
+	"log"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
 )
 
 // Roster query/result
 type RosterQuery struct {
-	XMLName xml.Name     `xml:"jabber:iq:roster query"`
-	Item    []RosterItem `xml:"item"`
+	XMLName xml.Name `xml:"jabber:iq:roster query"`
+	// The roster version, if the server supports versioning. In a
+	// request, an empty version asks for the whole roster. XEP-0237.
+	Ver  *string      `xml:"ver,attr"`
+	Item []RosterItem `xml:"item"`
 }
 
-// See RFC 3921, Section 7.1.
+// See RFC 6121, Section 2.1.2.
 type RosterItem struct {
 	XMLName      xml.Name `xml:"jabber:iq:roster item"`
 	Jid          JID      `xml:"jid,attr"`
-	Subscription string   `xml:"subscription,attr"`
-	Name         string   `xml:"name,attr"`
-	Group        []string
+	Subscription string   `xml:"subscription,attr,omitempty"`
+	Name         string   `xml:"name,attr,omitempty"`
+	// "subscribe" if we've asked to see the contact's presence
+	// and they haven't answered yet.
+	Ask string `xml:"ask,attr,omitempty"`
+	// Set if we've pre-approved the contact's subscription
+	// request.
+	Approved bool     `xml:"approved,attr,omitempty"`
+	Group    []string `xml:"group"`
 }
 
 type Roster struct {
 	Extension
-	get      chan []RosterItem
-	toServer chan Stanza
+	get chan []RosterItem
+	// Like get, but doesn't wait for the roster to arrive.
+	peek chan []RosterItem
+	// Roster results and pushes from the server.
+	changes chan rosterChange
+	// Changes the server has confirmed.
+	confirmed   chan RosterItem
+	subscribe   chan rosterSub
+	unsubscribe chan (<-chan RosterEvent)
+	client      *Client
 }
 
-type rosterClient struct {
-	rosterChan   <-chan []RosterItem
-	rosterUpdate chan<- RosterItem
+// What happened to a roster item.
+type RosterEventType int
+
+const (
+	// A contact was added to the roster.
+	RosterAdded RosterEventType = iota
+	// A contact's name, groups, or subscription changed.
+	RosterUpdated
+	// A contact was removed from the roster.
+	RosterRemoved
+	// The complete roster has been received from the server. The
+	// event's Item is empty.
+	RosterLoaded
+)
+
+// Describes a change to the roster.
+type RosterEvent struct {
+	Type RosterEventType
+	Item RosterItem
+}
+
+// A subscriber's events go in to a queue, and come out where the
+// subscriber reads them.
+type rosterSub struct {
+	in   chan<- RosterEvent
+	out  <-chan RosterEvent
+	stop chan struct{}
+}
+
+// A set of items to merge into the roster.
+type rosterChange struct {
+	items []RosterItem
+	// If set, items is the whole roster.
+	full bool
+	// If set, we're now in sync with the server.
+	loaded bool
+	// The server's version of the roster after this change.
+	ver string
+}
+
+// A RosterStore keeps a copy of the roster between sessions. With a
+// server that supports roster versioning, only changes since the
+// stored version need to be fetched. XEP-0237.
+type RosterStore interface {
+	// Returns the stored roster and its version. An empty store
+	// isn't an error, and has version "".
+	Load() (ver string, items []RosterItem, err error)
+	// Replaces the stored roster.
+	Save(ver string, items []RosterItem) error
 }
 
-func (r *Roster) rosterMgr(upd <-chan Stanza) {
+// FileRosterStore is a RosterStore kept in an XML file. Each account
+// needs its own file.
+type FileRosterStore struct {
+	Path string
+	lock sync.Mutex
+}
+
+var _ RosterStore = &FileRosterStore{}
+
+func (r *Roster) rosterMgr(done <-chan struct{}) {
 	roster := make(map[JID]RosterItem)
 	var snapshot []RosterItem
 	var get chan<- []RosterItem
+	var loaded bool
+	var subs []rosterSub
+	defer func() {
+		for _, sub := range subs {
+			close(sub.in)
+		}
+	}()
+	var events []RosterEvent
 	for {
+		// The version to save, if anything changed.
+		var ver string
 		select {
 		case get <- snapshot:
+			continue
 
-		case stan, ok := <-upd:
-			if !ok {
-				return
-			}
-			iq, ok := stan.(*Iq)
-			if !ok {
-				continue
+		case r.peek <- snapshot:
+			continue
+
+		case <-done:
+			return
+
+		case sub := <-r.subscribe:
+			// Catch the new subscriber up.
+			subs = append(subs, sub)
+			for _, item := range roster {
+				sub.in <- RosterEvent{Type: RosterAdded,
+					Item: item}
 			}
-			if iq.Type != "result" && iq.Type != "set" {
-				continue
+			if loaded {
+				sub.in <- RosterEvent{Type: RosterLoaded}
 			}
-			var rq *RosterQuery
-			for _, ele := range iq.Nested {
-				if q, ok := ele.(*RosterQuery); ok {
-					rq = q
+			continue
+
+		case unsub := <-r.unsubscribe:
+			for i, sub := range subs {
+				if sub.out == unsub {
+					close(sub.stop)
+					subs = append(subs[:i], subs[i+1:]...)
 					break
 				}
 			}
-			if rq == nil {
-				continue
+			continue
+
+		case change := <-r.changes:
+			ver = change.ver
+			if change.full {
+				// Anything not in the new roster is
+				// gone.
+				inNew := make(map[JID]bool)
+				for _, item := range change.items {
+					inNew[item.Jid] = true
+				}
+				for jid, item := range roster {
+					if !inNew[jid] {
+						item.Subscription = "remove"
+						events = applyRosterItem(roster,
+							item, events)
+					}
+				}
 			}
-			for _, item := range rq.Item {
-				roster[item.Jid] = item
+			for _, item := range change.items {
+				events = applyRosterItem(roster, item, events)
 			}
-			snapshot = []RosterItem{}
-			for _, ri := range roster {
-				snapshot = append(snapshot, ri)
+			if change.loaded {
+				loaded = true
+				events = append(events,
+					RosterEvent{Type: RosterLoaded})
+			}
+
+		case item := <-r.confirmed:
+			if item.Subscription != "remove" {
+				// The server knows the subscription
+				// state; we don't.
+				if old, ok := roster[item.Jid]; ok {
+					item.Subscription = old.Subscription
+					item.Ask = old.Ask
+					item.Approved = old.Approved
+				} else {
+					item.Subscription = "none"
+				}
+			}
+			events = applyRosterItem(roster, item, events)
+		}
+		snapshot = []RosterItem{}
+		for _, ri := range roster {
+			snapshot = append(snapshot, ri)
+		}
+		get = r.get
+		if store := r.client.rosterStore; store != nil && ver != "" {
+			err := store.Save(ver, snapshot)
+			if err != nil && Debug {
+				log.Printf("Saving roster: %v", err)
+			}
+		}
+		for _, ev := range events {
+			for _, sub := range subs {
+				sub.in <- ev
 			}
-			get = r.get
 		}
+		events = events[:0]
 	}
 }
 
-func (r *Roster) makeFilters() (Filter, Filter) {
-	rosterUpdate := make(chan Stanza)
-	go r.rosterMgr(rosterUpdate)
-	recv := func(in <-chan Stanza, out chan<- Stanza) {
-		defer close(out)
-		defer close(rosterUpdate)
-		for stan := range in {
-			rosterUpdate <- stan
-			out <- stan
+// Merge an item into the roster, and add an event describing what
+// changed, if anything, to events.
+func applyRosterItem(roster map[JID]RosterItem, item RosterItem,
+	events []RosterEvent) []RosterEvent {
+
+	old, exists := roster[item.Jid]
+	if item.Subscription == "remove" {
+		if !exists {
+			return events
 		}
+		delete(roster, item.Jid)
+		return append(events, RosterEvent{Type: RosterRemoved,
+			Item: old})
 	}
-	send := func(in <-chan Stanza, out chan<- Stanza) {
-		defer close(out)
-		for {
-			select {
-			case stan, ok := <-in:
-				if !ok {
-					return
-				}
-				out <- stan
-			case stan := <-r.toServer:
-				out <- stan
-			}
+	roster[item.Jid] = item
+	if !exists {
+		return append(events, RosterEvent{Type: RosterAdded,
+			Item: item})
+	}
+	if reflect.DeepEqual(old, item) {
+		return events
+	}
+	return append(events, RosterEvent{Type: RosterUpdated, Item: item})
+}
+
+// Handle a roster push from the server. Only our own account may
+// push roster changes, so pushes from anybody else are refused and
+// otherwise ignored. Each valid push is acknowledged. Pushes are
+// handled in the order they arrive, since a later push may undo an
+// earlier one. RFC 6121, section 2.1.6.
+func (r *Roster) handlePush(iq *Iq) *Iq {
+	cl := r.client
+	if iq.From != "" && !sameJid(iq.From, cl.Jid.Bare()) &&
+		!sameJid(iq.From, JID(cl.Jid.Domain())) {
+		if Debug {
+			log.Printf("Ignoring roster push from %s", iq.From)
 		}
+		return iq.ErrorReply(NewError(ErrorServiceUnavailable, ""))
+	}
+	rq := rosterQuery(iq)
+	if rq == nil || len(rq.Item) != 1 {
+		return iq.ErrorReply(NewError(ErrorBadRequest, ""))
+	}
+	change := rosterChange{items: rq.Item}
+	if rq.Ver != nil {
+		change.ver = *rq.Ver
+	}
+	select {
+	case r.changes <- change:
+	case <-cl.done:
+		return nil
 	}
-	return recv, send
+	return iq.Reply()
+}
+
+// Find the roster query in an iq, if there is one.
+func rosterQuery(iq *Iq) *RosterQuery {
+	for _, ele := range iq.Nested {
+		if q, ok := ele.(*RosterQuery); ok {
+			return q
+		}
+	}
+	return nil
 }
 
 func newRosterExt() *Roster {
@@ -107,12 +287,46 @@ func newRosterExt() *Roster {
 	r.StanzaTypes = make(map[xml.Name]reflect.Type)
 	rName := xml.Name{Space: NsRoster, Local: "query"}
 	r.StanzaTypes[rName] = reflect.TypeOf(RosterQuery{})
-	r.RecvFilter, r.SendFilter = r.makeFilters()
+	r.Init = func(cl *Client) {
+		cl.HandleIqInOrder("set", rName, r.handlePush)
+		go r.rosterMgr(cl.done)
+	}
 	r.get = make(chan []RosterItem)
-	r.toServer = make(chan Stanza)
+	r.peek = make(chan []RosterItem)
+	r.changes = make(chan rosterChange)
+	r.confirmed = make(chan RosterItem)
+	r.subscribe = make(chan rosterSub)
+	r.unsubscribe = make(chan (<-chan RosterEvent))
 	return &r
 }
 
+// Returns a channel on which changes to the roster will be delivered.
+// The current contents of the roster arrive first, as RosterAdded
+// events, followed by RosterLoaded if the roster has already been
+// fetched from the server. Events wait in a queue until they're read,
+// so a slow subscriber doesn't hold up the roster. The channel is
+// closed when the client shuts down or Unsubscribe is called.
+func (r *Roster) Subscribe() <-chan RosterEvent {
+	in := make(chan RosterEvent)
+	out := make(chan RosterEvent)
+	sub := rosterSub{in: in, out: out, stop: make(chan struct{})}
+	go queue(in, out, sub.stop)
+	select {
+	case r.subscribe <- sub:
+	case <-r.client.done:
+		close(in)
+	}
+	return out
+}
+
+// Stop delivering events on a channel returned by Subscribe.
+func (r *Roster) Unsubscribe(ch <-chan RosterEvent) {
+	select {
+	case r.unsubscribe <- ch:
+	case <-r.client.done:
+	}
+}
+
 // Return the most recent snapshot of the roster status. This is
 // updated automatically as roster updates are received from the
 // server. This function may block immediately after the XMPP
@@ -122,9 +336,144 @@ func (r *Roster) Get() []RosterItem {
 	return <-r.get
 }
 
-// Asynchronously fetch this entity's roster from the server.
+// Like Get, but returns straight away with whatever we have, which is
+// nothing until the roster arrives from the server, or after the
+// client shuts down.
+func (r *Roster) snapshot() []RosterItem {
+	select {
+	case items := <-r.peek:
+		return items
+	case <-r.client.done:
+		return nil
+	}
+}
+
+// Asynchronously fetch this entity's roster from the server. If the
+// server supports roster versioning and we have a stored copy, that
+// copy is used, and the server only sends what's changed since.
 func (r *Roster) update() {
-	iq := &Iq{Header: Header{Type: "get", Id: NextId(),
-		Nested: []interface{}{RosterQuery{}}}}
-	r.toServer <- iq
+	cl := r.client
+	go func() {
+		rq := RosterQuery{}
+		if cl.rosterStore != nil && cl.Features != nil &&
+			cl.Features.RosterVer != nil {
+			ver, items, err := cl.rosterStore.Load()
+			if err != nil {
+				if Debug {
+					log.Printf("Loading roster: %v", err)
+				}
+				ver, items = "", nil
+			}
+			rq.Ver = &ver
+			// This has to be in place before any pushes
+			// arrive.
+			select {
+			case r.changes <- rosterChange{items: items,
+				full: true}:
+			case <-cl.done:
+				return
+			}
+		}
+		iq := NewIq(IqGet, "", rq)
+		reply, err := cl.SendIq(context.Background(), iq)
+		if err != nil {
+			if Debug {
+				log.Printf("Roster fetch: %v", err)
+			}
+			return
+		}
+		// An empty result means our copy is current.
+		change := rosterChange{loaded: true}
+		if res := rosterQuery(reply); res != nil {
+			change.items = res.Item
+			change.full = true
+			if res.Ver != nil {
+				change.ver = *res.Ver
+			}
+		}
+		select {
+		case r.changes <- change:
+		case <-cl.done:
+		}
+	}()
+}
+
+// Add a contact to the roster, or change the name and groups of one
+// that's already there. This blocks until the server has accepted or
+// rejected the change, and returns the server's error, if any.
+// Accepted changes are reflected in Get.
+func (r *Roster) Set(ctx context.Context, jid JID, name string,
+	groups []string) error {
+
+	item := RosterItem{Jid: jid, Name: name, Group: groups}
+	return r.set(ctx, item)
+}
+
+// Remove a contact from the roster. This also cancels any presence
+// subscriptions in both directions. RFC 6121, section 2.5.
+func (r *Roster) Remove(ctx context.Context, jid JID) error {
+	item := RosterItem{Jid: jid, Subscription: "remove"}
+	return r.set(ctx, item)
+}
+
+func (r *Roster) set(ctx context.Context, item RosterItem) error {
+	iq := NewIq(IqSet, "", RosterQuery{Item: []RosterItem{item}})
+	if _, err := r.client.SendIq(ctx, iq); err != nil {
+		return err
+	}
+	select {
+	case r.confirmed <- item:
+	case <-r.client.done:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+func (s *FileRosterStore) Load() (string, []RosterItem, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	buf, err := os.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	var rq RosterQuery
+	if err := xml.Unmarshal(buf, &rq); err != nil {
+		return "", nil, err
+	}
+	if rq.Ver == nil {
+		return "", rq.Item, nil
+	}
+	return *rq.Ver, rq.Item, nil
+}
+
+func (s *FileRosterStore) Save(ver string, items []RosterItem) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	buf, err := xml.Marshal(RosterQuery{Ver: &ver, Item: items})
+	if err != nil {
+		return err
+	}
+	// Write a new file and move it into place, so a crash can't
+	// leave half a roster behind.
+	f, err := os.CreateTemp(filepath.Dir(s.Path),
+		filepath.Base(s.Path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.Path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
 }
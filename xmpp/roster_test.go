@@ -1,9 +1,14 @@
 package xmpp
 
 import (
+	"context"
 	"encoding/xml"
+	"errors"
+	"fmt"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 // This is mostly just tests of the roster data structures.
@@ -51,3 +56,340 @@ func TestRosterIqUnmarshal(t *testing.T) {
 	item := rq.Item[0]
 	assertEquals(t, "a@b.c", string(item.Jid))
 }
+
+func TestRosterItemMarshal(t *testing.T) {
+	item := RosterItem{Jid: "a@b.c", Name: "A", Group: []string{"x", "y"}}
+	exp := `<item xmlns="` + NsRoster + `" jid="a@b.c" name="A">` +
+		`<group>x</group><group>y</group></item>`
+	assertMarshal(t, exp, item)
+
+	item = RosterItem{Jid: "a@b.c", Subscription: "remove"}
+	exp = `<item xmlns="` + NsRoster + `" jid="a@b.c"` +
+		` subscription="remove"></item>`
+	assertMarshal(t, exp, item)
+}
+
+// Answer the next roster set the client sends with the given reply
+// type, and return the item it contained.
+func answerRosterSet(t *testing.T, recv chan<- interface{},
+	sent <-chan Stanza, typ string) RosterItem {
+
+	iq := (<-sent).(*Iq)
+	assertEquals(t, "set", iq.Type)
+	rq := iq.Nested[0].(RosterQuery)
+	if len(rq.Item) != 1 {
+		t.Fatalf("wrong items %v", rq.Item)
+	}
+	reply := iq.Reply()
+	if typ == "error" {
+		reply = iq.ErrorReply(NewError(ErrorNotAllowed, ""))
+	}
+	recv <- reply
+	return rq.Item[0]
+}
+
+func TestRosterSet(t *testing.T) {
+	cl, recv, sent := newTestClient()
+	defer close(recv)
+	r := newRosterExt()
+	r.client = cl
+	r.Init(cl)
+	ctx := context.Background()
+
+	done := make(chan error)
+	go func() {
+		done <- r.Set(ctx, "a@b.c", "A", []string{"Friends"})
+	}()
+	item := answerRosterSet(t, recv, sent, "result")
+	assertEquals(t, "a@b.c", string(item.Jid))
+	assertEquals(t, "A", item.Name)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	items := r.Get()
+	if len(items) != 1 || items[0].Name != "A" ||
+		items[0].Group[0] != "Friends" {
+		t.Fatalf("roster %v", items)
+	}
+
+	// A rejected change doesn't show up.
+	go func() {
+		done <- r.Set(ctx, "a@b.c", "B", nil)
+	}()
+	answerRosterSet(t, recv, sent, "error")
+	if err := <-done; !errors.Is(err, ErrorNotAllowed) {
+		t.Errorf("wrong error %v", err)
+	}
+	if items := r.Get(); items[0].Name != "A" {
+		t.Errorf("roster %v", items)
+	}
+
+	go func() {
+		done <- r.Remove(ctx, "a@b.c")
+	}()
+	item = answerRosterSet(t, recv, sent, "result")
+	assertEquals(t, "remove", item.Subscription)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if items := r.Get(); len(items) != 0 {
+		t.Errorf("roster %v", items)
+	}
+}
+
+func rosterPush(from JID, item RosterItem) *Iq {
+	iq := &Iq{Header: Header{From: from, Id: NextId(), Type: "set"}}
+	iq.Nested = []interface{}{&RosterQuery{Item: []RosterItem{item}}}
+	return iq
+}
+
+func TestRosterPush(t *testing.T) {
+	cl, recv, sent := newTestClient()
+	defer close(recv)
+	r := newRosterExt()
+	r.client = cl
+	r.Init(cl)
+
+	// Start with the roster fetched from the server.
+	r.update()
+	iq := (<-sent).(*Iq)
+	reply := iq.Reply(&RosterQuery{Item: []RosterItem{
+		{Jid: "a@b.c", Subscription: "both"},
+		{Jid: "d@e.f", Subscription: "to"}}})
+	recv <- reply
+	if items := r.Get(); len(items) != 2 {
+		t.Fatalf("roster %v", items)
+	}
+
+	reply = r.handlePush(rosterPush("", RosterItem{Jid: "g@h.i",
+		Subscription: "none"}))
+	assertEquals(t, "result", reply.Type)
+	reply = r.handlePush(rosterPush("me@example.com",
+		RosterItem{Jid: "a@b.c", Subscription: "remove"}))
+	assertEquals(t, "result", reply.Type)
+
+	// Nobody else can push.
+	reply = r.handlePush(rosterPush("evil@example.com/x",
+		RosterItem{Jid: "evil@example.com"}))
+	assertEquals(t, "error", reply.Type)
+
+	items := r.Get()
+	jids := make(map[JID]bool)
+	for _, item := range items {
+		jids[item.Jid] = true
+	}
+	if len(items) != 2 || !jids["d@e.f"] || !jids["g@h.i"] {
+		t.Errorf("roster %v", items)
+	}
+}
+
+// Route a burst of pushes like the ones from the server, each with
+// its raw XML so routeIq can tell what it is, and wait for them all
+// to be acknowledged.
+func routePushes(t *testing.T, in chan<- Stanza, sent <-chan Stanza,
+	pushes ...*Iq) {
+
+	for _, iq := range pushes {
+		x, err := xml.Marshal(iq.Nested[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		iq.Innerxml = string(x)
+		in <- iq
+	}
+	for range pushes {
+		if reply := (<-sent).(*Iq); reply.Type != "result" {
+			t.Fatalf("reply %v", reply)
+		}
+	}
+}
+
+func TestRosterPushOrder(t *testing.T) {
+	cl, recv, sent := newTestClient()
+	defer close(recv)
+	r := newRosterExt()
+	r.client = cl
+	r.Init(cl)
+	in := make(chan Stanza)
+	go cl.routeIq(in, make(chan Stanza))
+	defer close(in)
+
+	r.update()
+	iq := (<-sent).(*Iq)
+	recv <- iq.Reply(&RosterQuery{})
+	r.Get()
+
+	// Each contact is added and then removed.
+	var pushes []*Iq
+	for i := 0; i < 10; i++ {
+		jid := JID(fmt.Sprintf("x%d@example.com", i))
+		pushes = append(pushes,
+			rosterPush("", RosterItem{Jid: "w@example.com",
+				Name: fmt.Sprint(i)}),
+			rosterPush("", RosterItem{Jid: jid}),
+			rosterPush("", RosterItem{Jid: jid,
+				Subscription: "remove"}))
+	}
+	routePushes(t, in, sent, pushes...)
+	items := r.Get()
+	if len(items) != 1 || items[0].Name != "9" {
+		t.Errorf("roster %v", items)
+	}
+}
+
+func expectRosterEvent(t *testing.T, ch <-chan RosterEvent,
+	typ RosterEventType) RosterEvent {
+
+	select {
+	case ev := <-ch:
+		if ev.Type != typ {
+			t.Fatalf("got event %v, expected type %d", ev, typ)
+		}
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no roster event")
+	}
+	return RosterEvent{}
+}
+
+func TestRosterEvents(t *testing.T) {
+	cl, recv, sent := newTestClient()
+	r := newRosterExt()
+	r.client = cl
+	r.Init(cl)
+	events := r.Subscribe()
+
+	r.update()
+	iq := (<-sent).(*Iq)
+	recv <- iq.Reply(&RosterQuery{Item: []RosterItem{
+		{Jid: "a@b.c", Subscription: "both"}}})
+	ev := expectRosterEvent(t, events, RosterAdded)
+	assertEquals(t, "a@b.c", string(ev.Item.Jid))
+	expectRosterEvent(t, events, RosterLoaded)
+
+	// Pushing an unchanged item is not an event.
+	r.handlePush(rosterPush("", RosterItem{Jid: "a@b.c",
+		Subscription: "both"}))
+	r.handlePush(rosterPush("", RosterItem{Jid: "a@b.c", Name: "A",
+		Subscription: "both"}))
+	ev = expectRosterEvent(t, events, RosterUpdated)
+	assertEquals(t, "A", ev.Item.Name)
+
+	// A late subscriber catches up.
+	late := r.Subscribe()
+	ev = expectRosterEvent(t, late, RosterAdded)
+	assertEquals(t, "A", ev.Item.Name)
+	expectRosterEvent(t, late, RosterLoaded)
+	r.Unsubscribe(late)
+	if _, ok := <-late; ok {
+		t.Error("event after unsubscribing")
+	}
+
+	// Nor does a subscriber that has stopped reading hold anybody
+	// up.
+	idle := r.Subscribe()
+	for i := 0; i < 200; i++ {
+		r.handlePush(rosterPush("", RosterItem{Jid: "a@b.c",
+			Name: fmt.Sprint(i), Subscription: "both"}))
+		expectRosterEvent(t, events, RosterUpdated)
+	}
+	r.Get()
+	r.Unsubscribe(idle)
+	for range idle {
+	}
+
+	r.handlePush(rosterPush("", RosterItem{Jid: "a@b.c",
+		Subscription: "remove"}))
+	ev = expectRosterEvent(t, events, RosterRemoved)
+	assertEquals(t, "199", ev.Item.Name)
+
+	close(recv)
+	if _, ok := <-events; ok {
+		t.Error("events not closed at shutdown")
+	}
+}
+
+func TestRosterVersioning(t *testing.T) {
+	cl, recv, sent := newTestClient()
+	defer close(recv)
+	store := &FileRosterStore{Path: filepath.Join(t.TempDir(), "roster")}
+	if ver, items, err := store.Load(); err != nil || ver != "" ||
+		items != nil {
+		t.Fatalf("empty store: %q %v %v", ver, items, err)
+	}
+	err := store.Save("v1", []RosterItem{{Jid: "a@b.c",
+		Subscription: "both"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl.rosterStore = store
+	cl.Features = &Features{RosterVer: &Generic{}}
+	r := newRosterExt()
+	r.client = cl
+	r.Init(cl)
+	events := r.Subscribe()
+
+	// The server says our copy is current.
+	r.update()
+	iq := (<-sent).(*Iq)
+	rq := iq.Nested[0].(RosterQuery)
+	if rq.Ver == nil || *rq.Ver != "v1" {
+		t.Fatalf("wrong version requested %v", rq.Ver)
+	}
+	recv <- iq.Reply()
+	ev := expectRosterEvent(t, events, RosterAdded)
+	assertEquals(t, "a@b.c", string(ev.Item.Jid))
+	expectRosterEvent(t, events, RosterLoaded)
+
+	// Versioned pushes update the store.
+	push := rosterPush("", RosterItem{Jid: "d@e.f", Subscription: "to"})
+	ver := "v2"
+	push.Nested[0].(*RosterQuery).Ver = &ver
+	r.handlePush(push)
+	expectRosterEvent(t, events, RosterAdded)
+	ver, items, err := store.Load()
+	if err != nil || ver != "v2" || len(items) != 2 {
+		t.Errorf("stored %q %v %v", ver, items, err)
+	}
+
+	// An incremental update is a burst of pushes, and the store
+	// ends up with the last version and the items that go with it.
+	in := make(chan Stanza)
+	go cl.routeIq(in, make(chan Stanza))
+	defer close(in)
+	var pushes []*Iq
+	for i := 3; i <= 20; i++ {
+		v := fmt.Sprintf("v%d", i)
+		push := rosterPush("", RosterItem{Jid: "d@e.f", Name: v,
+			Subscription: "to"})
+		push.Nested[0].(*RosterQuery).Ver = &v
+		pushes = append(pushes, push)
+	}
+	routePushes(t, in, sent, pushes...)
+	r.Get()
+	ver, items, err = store.Load()
+	if err != nil || ver != "v20" || len(items) != 2 {
+		t.Fatalf("stored %q %v %v", ver, items, err)
+	}
+	for _, item := range items {
+		if item.Jid == "d@e.f" && item.Name != "v20" {
+			t.Errorf("stored %v with %q", item, ver)
+		}
+	}
+}
+
+func TestRosterVerMarshal(t *testing.T) {
+	ver := ""
+	exp := `<query xmlns="` + NsRoster + `" ver=""></query>`
+	assertMarshal(t, exp, RosterQuery{Ver: &ver})
+
+	var fe Features
+	str := `<features xmlns="` + NsStream + `"><ver xmlns="` +
+		NsRosterVer + `"/></features>`
+	if err := xml.Unmarshal([]byte(str), &fe); err != nil {
+		t.Fatal(err)
+	}
+	if fe.RosterVer == nil {
+		t.Error("no rosterver feature")
+	}
+}
@@ -0,0 +1,56 @@
+package xmpp
+
+// This file contains support for result set management, XEP-0059,
+// which pages through long lists of results.
+
+import (
+	"encoding/xml"
+)
+
+const NsRsm = "http://jabber.org/protocol/rsm"
+
+// Asks for one page of a result set, or describes the page returned.
+type RsmSet struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/rsm set"`
+	// The most results to return.
+	Max *int `xml:"max"`
+	// Asks for the page after the result with this id.
+	After string `xml:"after,omitempty"`
+	// Asks for the page before the result with this id. An empty
+	// string asks for the last page.
+	Before *string `xml:"before"`
+	// Asks for the page starting at this position.
+	Index *int `xml:"index"`
+	// In a reply, the first and last results on the page, and the
+	// number of results in the whole set.
+	First *RsmFirst `xml:"first"`
+	Last  string    `xml:"last,omitempty"`
+	Count *int      `xml:"count"`
+	// How many results the page held, if we know.
+	size int
+}
+
+type RsmFirst struct {
+	Index *int   `xml:"index,attr"`
+	Id    string `xml:",chardata"`
+}
+
+// Asks for the first page, of at most max results.
+func NewRsmSet(max int) *RsmSet {
+	return &RsmSet{Max: &max}
+}
+
+// Given the description of a page, asks for the next one, of at most
+// max results. Returns nil if there's nothing after the page: it was
+// empty, or it held the last result, as its position in the set and
+// the set's size show.
+func (s *RsmSet) Next(max int) *RsmSet {
+	if s.Last == "" {
+		return nil
+	}
+	if s.First != nil && s.First.Index != nil && s.Count != nil &&
+		s.size > 0 && *s.First.Index+s.size >= *s.Count {
+		return nil
+	}
+	return &RsmSet{Max: &max, After: s.Last}
+}
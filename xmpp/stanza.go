@@ -0,0 +1,240 @@
+package xmpp
+
+// This file contains the values stanza types can take, helpers for
+// building common stanzas, and checks that outgoing stanzas make
+// sense.
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Values for the type of a message stanza. RFC 6121, section 5.2.2.
+type MessageType string
+
+const (
+	MessageNormal    MessageType = "normal"
+	MessageChat      MessageType = "chat"
+	MessageGroupchat MessageType = "groupchat"
+	MessageHeadline  MessageType = "headline"
+	MessageError     MessageType = "error"
+)
+
+// Values for the type of a presence stanza. RFC 6121, section 4.7.1.
+type PresenceType string
+
+const (
+	// Available presence has no type.
+	PresenceAvailable    PresenceType = ""
+	PresenceUnavailable  PresenceType = "unavailable"
+	PresenceSubscribe    PresenceType = "subscribe"
+	PresenceSubscribed   PresenceType = "subscribed"
+	PresenceUnsubscribe  PresenceType = "unsubscribe"
+	PresenceUnsubscribed PresenceType = "unsubscribed"
+	PresenceProbe        PresenceType = "probe"
+	PresenceError        PresenceType = "error"
+)
+
+// Values for the show element of an available presence stanza. RFC
+// 6121, section 4.7.2.1.
+type PresenceShow string
+
+const (
+	// Plain available, which is sent without a show element.
+	ShowAvailable PresenceShow = ""
+	ShowChat      PresenceShow = "chat"
+	ShowAway      PresenceShow = "away"
+	ShowXa        PresenceShow = "xa"
+	ShowDnd       PresenceShow = "dnd"
+)
+
+// Values for the type of an iq stanza. RFC 6120, section 8.2.3.
+type IqType string
+
+const (
+	IqGet    IqType = "get"
+	IqSet    IqType = "set"
+	IqResult IqType = "result"
+	IqError  IqType = "error"
+)
+
+// Returned, wrapped, by Validate for a stanza which mustn't be sent.
+var ErrInvalidStanza = errors.New("invalid stanza")
+
+// Creates a message with the given type and body.
+func NewMessage(to JID, typ MessageType, body string) *Message {
+	m := &Message{Header: Header{To: to, Type: string(typ)}}
+	if body != "" {
+		m.Body = []Text{{Chardata: body}}
+	}
+	return m
+}
+
+// Creates a broadcast available presence. The status text is
+// optional. The priority must be between -128 and 127.
+func NewAvailablePresence(show PresenceShow, status string,
+	priority int) *Presence {
+
+	p := &Presence{}
+	if show != ShowAvailable {
+		p.Show = &Data{Chardata: string(show)}
+	}
+	if status != "" {
+		p.Status = []Text{{Chardata: status}}
+	}
+	if priority != 0 {
+		p.Priority = &Data{Chardata: strconv.Itoa(priority)}
+	}
+	return p
+}
+
+// Creates an iq with the given type and payload. SendIq will assign
+// its id.
+func NewIq(typ IqType, to JID, nested ...interface{}) *Iq {
+	iq := &Iq{Header: Header{To: to, Type: string(typ)}}
+	iq.Nested = nested
+	return iq
+}
+
+// Returns the presence's show value.
+func (p *Presence) GetShow() PresenceShow {
+	if p.Show == nil {
+		return ShowAvailable
+	}
+	return PresenceShow(strings.TrimSpace(p.Show.Chardata))
+}
+
+// Returns the presence's priority, which is 0 if it's missing or
+// invalid.
+func (p *Presence) GetPriority() int {
+	prio, err := p.priority()
+	if err != nil {
+		return 0
+	}
+	return prio
+}
+
+func (p *Presence) priority() (int, error) {
+	if p.Priority == nil {
+		return 0, nil
+	}
+	prio, err := strconv.Atoi(strings.TrimSpace(p.Priority.Chardata))
+	if err != nil {
+		return 0, err
+	}
+	if prio < -128 || prio > 127 {
+		return 0, fmt.Errorf("priority %d out of range", prio)
+	}
+	return prio, nil
+}
+
+// Check that a stanza is fit to send: that its type is one the RFCs
+// define, that an error has an error element, that an iq has an id
+// and the right number of children, and so on. Stanzas going out
+// through Client.Send are checked, and are dropped if they fail;
+// Client.SendStanza returns the error instead.
+func Validate(st Stanza) error {
+	if st == nil {
+		return fmt.Errorf("%w: nil", ErrInvalidStanza)
+	}
+	var err error
+	switch st := st.(type) {
+	case *Message:
+		err = validateMessage(st)
+	case *Presence:
+		err = validatePresence(st)
+	case *Iq:
+		err = validateIq(st)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidStanza, err)
+	}
+	return nil
+}
+
+func validateMessage(m *Message) error {
+	switch MessageType(m.Type) {
+	case "", MessageNormal, MessageChat, MessageGroupchat,
+		MessageHeadline:
+	case MessageError:
+		if m.Error == nil {
+			return errors.New("error message without error")
+		}
+	default:
+		return fmt.Errorf("bad message type %q", m.Type)
+	}
+	return nil
+}
+
+func validatePresence(p *Presence) error {
+	switch PresenceType(p.Type) {
+	case PresenceAvailable, PresenceUnavailable, PresenceSubscribe,
+		PresenceSubscribed, PresenceUnsubscribe,
+		PresenceUnsubscribed, PresenceProbe:
+	case PresenceError:
+		if p.Error == nil {
+			return errors.New("error presence without error")
+		}
+	default:
+		return fmt.Errorf("bad presence type %q", p.Type)
+	}
+	switch p.GetShow() {
+	case ShowAvailable, ShowChat, ShowAway, ShowXa, ShowDnd:
+	default:
+		return fmt.Errorf("bad show %q", p.Show.Chardata)
+	}
+	if _, err := p.priority(); err != nil {
+		return fmt.Errorf("bad priority: %v", err)
+	}
+	return nil
+}
+
+func validateIq(iq *Iq) error {
+	if iq.Id == "" {
+		return errors.New("iq without id")
+	}
+	children := len(iq.Nested) + countElements(iq.Innerxml)
+	switch IqType(iq.Type) {
+	case IqGet, IqSet:
+		if children != 1 {
+			return fmt.Errorf("%s iq with %d children", iq.Type,
+				children)
+		}
+	case IqResult:
+		if children > 1 {
+			return fmt.Errorf("result iq with %d children",
+				children)
+		}
+	case IqError:
+		if iq.Error == nil {
+			return errors.New("error iq without error")
+		}
+	default:
+		return fmt.Errorf("bad iq type %q", iq.Type)
+	}
+	return nil
+}
+
+// Count the top-level elements in a fragment of XML.
+func countElements(frag string) int {
+	dec := xml.NewDecoder(strings.NewReader(frag))
+	n, depth := 0, 0
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return n
+		}
+		switch t.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				n++
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"testing"
+)
+
+func TestNewAvailablePresence(t *testing.T) {
+	p := NewAvailablePresence(ShowAway, "lunch", -1)
+	exp := `<presence><show xmlns="jabber:client">away</show>` +
+		`<status xmlns="jabber:client">lunch</status>` +
+		`<priority xmlns="jabber:client">-1</priority></presence>`
+	assertMarshal(t, exp, p)
+	if p.GetShow() != ShowAway || p.GetPriority() != -1 {
+		t.Errorf("show %q priority %d", p.GetShow(), p.GetPriority())
+	}
+
+	assertMarshal(t, `<presence></presence>`,
+		NewAvailablePresence(ShowAvailable, "", 0))
+}
+
+func TestNewMessage(t *testing.T) {
+	m := NewMessage("you@example.com", MessageChat, "hi")
+	exp := `<message xmlns="jabber:client" to="you@example.com"` +
+		` type="chat"><body xmlns="jabber:client">hi</body></message>`
+	assertMarshal(t, exp, m)
+}
+
+func TestValidate(t *testing.T) {
+	query := &Generic{XMLName: xml.Name{Space: "urn:example",
+		Local: "query"}}
+	withId := func(iq *Iq) *Iq {
+		iq.Id = "1"
+		return iq
+	}
+	good := []Stanza{
+		NewMessage("you@example.com", MessageHeadline, "news"),
+		&Message{},
+		NewAvailablePresence(ShowDnd, "busy", 127),
+		&Presence{Header: Header{Type: "unsubscribed"}},
+		withId(NewIq(IqGet, "", query)),
+		withId(NewIq(IqResult, "")),
+		&Iq{Header: Header{Id: "1", Type: "set",
+			Innerxml: `<query xmlns="urn:example"><x/></query>`}},
+		withId(NewIq(IqGet, "", query)).ErrorReply(
+			NewError(ErrorBadRequest, "")),
+	}
+	for _, st := range good {
+		if err := Validate(st); err != nil {
+			t.Errorf("%#v: %v", st, err)
+		}
+	}
+
+	bad := []Stanza{
+		nil,
+		&Message{Header: Header{Type: "shout"}},
+		&Message{Header: Header{Type: "error"}},
+		&Presence{Header: Header{Type: "available"}},
+		NewAvailablePresence("busy", "", 0),
+		NewAvailablePresence(ShowAway, "", 128),
+		&Presence{Priority: &Data{Chardata: "high"}},
+		NewIq(IqGet, "", query),
+		withId(NewIq(IqGet, "")),
+		withId(NewIq(IqSet, "", query, query)),
+		withId(NewIq(IqResult, "", query, query)),
+		withId(NewIq(IqError, "")),
+		withId(NewIq("fetch", "", query)),
+		&Iq{Header: Header{Id: "1", Type: "set",
+			Innerxml: `<a xmlns="urn:example"/><b/>`}},
+	}
+	for _, st := range bad {
+		if err := Validate(st); !errors.Is(err, ErrInvalidStanza) {
+			t.Errorf("%#v: %v", st, err)
+		}
+	}
+}
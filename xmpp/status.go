@@ -11,6 +11,7 @@ type Status int
 
 const (
 	statusUnconnected = iota
+	statusRedirected
 	statusConnected
 	statusConnectedTls
 	statusAuthenticated
@@ -24,6 +25,12 @@ var (
 	// The client has not yet connected, or it has been
 	// disconnected from the server.
 	StatusUnconnected Status = statusUnconnected
+	// The server sent us to another host once the session was
+	// running, and the session is gone: contacts' presence, the
+	// rooms we were in and the like have to be set up again. The
+	// status goes on through StatusConnected to StatusRunning on
+	// the new host. See ClientOptions.FollowRedirects.
+	StatusRedirected Status = statusRedirected
 	// Initial connection established.
 	StatusConnected Status = statusConnected
 	// Like StatusConnected, but with TLS.
@@ -56,17 +63,21 @@ func (s Status) Fatal() bool {
 type statmgr struct {
 	newStatus   chan Status
 	newlistener chan chan Status
+	// Closed when the manager has finished.
+	stopped chan struct{}
 }
 
 func newStatmgr(client chan<- Status) *statmgr {
 	s := statmgr{}
 	s.newStatus = make(chan Status)
 	s.newlistener = make(chan chan Status)
+	s.stopped = make(chan struct{})
 	go s.manager(client)
 	return &s
 }
 
 func (s *statmgr) manager(client chan<- Status) {
+	defer close(s.stopped)
 	// We handle this specially, in case the client doesn't read
 	// our final status message.
 	defer func() {
@@ -115,8 +126,12 @@ func (cl *Client) setStatus(stat Status) {
 	cl.statmgr.setStatus(stat)
 }
 
+// Once the stream has ended, there's nobody left to tell.
 func (s *statmgr) setStatus(stat Status) {
-	s.newStatus <- stat
+	select {
+	case s.newStatus <- stat:
+	case <-s.stopped:
+	}
 }
 
 func (s *statmgr) newListener() <-chan Status {
@@ -125,6 +140,16 @@ func (s *statmgr) newListener() <-chan Status {
 	return l
 }
 
+// Like newListener, but every status is delivered, however slowly the
+// listener reads.
+func (s *statmgr) newQueuedListener() <-chan Status {
+	l := make(chan Status)
+	out := make(chan Status)
+	go queue(l, out, nil)
+	s.newlistener <- l
+	return out
+}
+
 func (s *statmgr) close() {
 	close(s.newlistener)
 }
@@ -146,3 +171,25 @@ func (s *statmgr) awaitStatus(waitFor Status) error {
 	}
 	return fmt.Errorf("shut down waiting for status change")
 }
+
+// Pass status changes from one connection attempt on to the
+// application. Fatal statuses are held back until we know, from
+// final, whether this attempt is the last one. If it isn't, the
+// application never hears about the failure and its channel stays
+// open for the next attempt.
+func forwardStatus(in <-chan Status, out chan<- Status, final <-chan bool) {
+	var held []Status
+	for stat := range in {
+		if stat.Fatal() {
+			held = append(held, stat)
+			continue
+		}
+		out <- stat
+	}
+	if <-final {
+		for _, stat := range held {
+			out <- stat
+		}
+		close(out)
+	}
+}
@@ -61,3 +61,45 @@ func TestAwaitStatus(t *testing.T) {
 	}
 	<-syncCh
 }
+
+func TestForwardStatus(t *testing.T) {
+	in := make(chan Status)
+	out := make(chan Status, 10)
+	final := make(chan bool, 1)
+	go func() {
+		in <- StatusConnected
+		in <- StatusError
+		in <- StatusShutdown
+		close(in)
+	}()
+	go forwardStatus(in, out, final)
+	if stat := <-out; stat != StatusConnected {
+		t.Errorf("got %d", stat)
+	}
+	final <- false
+	// The failure isn't passed on, and out stays open.
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case stat := <-out:
+		t.Errorf("got %d", stat)
+	default:
+	}
+
+	in2 := make(chan Status)
+	final = make(chan bool, 1)
+	go func() {
+		in2 <- StatusConnected
+		in2 <- StatusError
+		close(in2)
+	}()
+	go forwardStatus(in2, out, final)
+	final <- true
+	for _, exp := range []Status{StatusConnected, StatusError} {
+		if stat := <-out; stat != exp {
+			t.Errorf("got %d, want %d", stat, exp)
+		}
+	}
+	if _, ok := <-out; ok {
+		t.Error("out not closed")
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"bytes"
 	"encoding/xml"
 	"fmt"
-	"log"
 	"reflect"
 	"strings"
 )
@@ -38,6 +37,55 @@ type streamError struct {
 	Text    *errText
 }
 
+// StreamError is reported when the server closes the stream because
+// of an error. See RFC 6120, section 4.9.
+type StreamError struct {
+	Condition StreamCondition
+	// Optional human-readable description, and its language.
+	Text string
+	Lang string
+	// For StreamSeeOtherHost, the host we should connect to
+	// instead.
+	OtherHost string
+}
+
+var _ error = &StreamError{}
+
+// The defined conditions for stream errors. RFC 6120, section
+// 4.9.3. A StreamCondition is also an error, so errors.Is can be used
+// to test a StreamError's condition.
+type StreamCondition string
+
+const (
+	StreamBadFormat              StreamCondition = "bad-format"
+	StreamBadNamespacePrefix     StreamCondition = "bad-namespace-prefix"
+	StreamConflict               StreamCondition = "conflict"
+	StreamConnectionTimeout      StreamCondition = "connection-timeout"
+	StreamHostGone               StreamCondition = "host-gone"
+	StreamHostUnknown            StreamCondition = "host-unknown"
+	StreamImproperAddressing     StreamCondition = "improper-addressing"
+	StreamInternalServerError    StreamCondition = "internal-server-error"
+	StreamInvalidFrom            StreamCondition = "invalid-from"
+	StreamInvalidNamespace       StreamCondition = "invalid-namespace"
+	StreamInvalidXML             StreamCondition = "invalid-xml"
+	StreamNotAuthorized          StreamCondition = "not-authorized"
+	StreamNotWellFormed          StreamCondition = "not-well-formed"
+	StreamPolicyViolation        StreamCondition = "policy-violation"
+	StreamRemoteConnectionFailed StreamCondition = "remote-connection-failed"
+	StreamReset                  StreamCondition = "reset"
+	StreamResourceConstraint     StreamCondition = "resource-constraint"
+	StreamRestrictedXML          StreamCondition = "restricted-xml"
+	StreamSeeOtherHost           StreamCondition = "see-other-host"
+	StreamSystemShutdown         StreamCondition = "system-shutdown"
+	StreamUndefinedCondition     StreamCondition = "undefined-condition"
+	StreamUnsupportedEncoding    StreamCondition = "unsupported-encoding"
+	StreamUnsupportedFeature     StreamCondition = "unsupported-feature"
+	StreamUnsupportedStanzaType  StreamCondition = "unsupported-stanza-type"
+	StreamUnsupportedVersion     StreamCondition = "unsupported-version"
+)
+
+var _ error = StreamConflict
+
 type errText struct {
 	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-streams text"`
 	Lang    string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
@@ -49,7 +97,10 @@ type Features struct {
 	Mechanisms mechs     `xml:"urn:ietf:params:xml:ns:xmpp-sasl mechanisms"`
 	Bind       *bindIq
 	Session    *Generic
-	Any        *Generic
+	RosterVer  *Generic `xml:"urn:xmpp:features:rosterver ver"`
+	// RFC 6121, section 3.4.
+	PreApproval *Generic `xml:"urn:xmpp:features:pre-approval sub"`
+	Any         *Generic
 }
 
 type starttls struct {
@@ -115,16 +166,92 @@ type Iq struct {
 
 var _ Stanza = &Iq{}
 
-// Describes an XMPP stanza error. See RFC 3920, Section 9.3.
+// Describes an XMPP stanza error. See RFC 6120, Section 8.3. An Error
+// can be compared to an ErrorCondition with errors.Is.
 type Error struct {
 	XMLName xml.Name `xml:"error"`
-	// The error type attribute.
+	// The error type attribute: one of the ErrorType constants.
 	Type string `xml:"type,attr"`
-	// Any nested element, if present.
+	// The defined condition.
+	Condition ErrorCondition
+	// The content of the condition element. For gone and redirect,
+	// this is the URI of the new address.
+	ConditionText string
+	// Optional human-readable description, and its language.
+	Text string
+	Lang string
+	// An application-specific condition element, if present.
 	Any *Generic
 }
 
 var _ error = &Error{}
+var _ xml.Marshaler = &Error{}
+var _ xml.Unmarshaler = &Error{}
+
+// Values for Error.Type.
+const (
+	ErrorTypeAuth     = "auth"
+	ErrorTypeCancel   = "cancel"
+	ErrorTypeContinue = "continue"
+	ErrorTypeModify   = "modify"
+	ErrorTypeWait     = "wait"
+)
+
+// The defined conditions for stanza errors. RFC 6120, section 8.3.3.
+type ErrorCondition string
+
+const (
+	ErrorBadRequest            ErrorCondition = "bad-request"
+	ErrorConflict              ErrorCondition = "conflict"
+	ErrorFeatureNotImplemented ErrorCondition = "feature-not-implemented"
+	ErrorForbidden             ErrorCondition = "forbidden"
+	ErrorGone                  ErrorCondition = "gone"
+	ErrorInternalServerError   ErrorCondition = "internal-server-error"
+	ErrorItemNotFound          ErrorCondition = "item-not-found"
+	ErrorJidMalformed          ErrorCondition = "jid-malformed"
+	ErrorNotAcceptable         ErrorCondition = "not-acceptable"
+	ErrorNotAllowed            ErrorCondition = "not-allowed"
+	ErrorNotAuthorized         ErrorCondition = "not-authorized"
+	ErrorPolicyViolation       ErrorCondition = "policy-violation"
+	ErrorRecipientUnavailable  ErrorCondition = "recipient-unavailable"
+	ErrorRedirect              ErrorCondition = "redirect"
+	ErrorRegistrationRequired  ErrorCondition = "registration-required"
+	ErrorRemoteServerNotFound  ErrorCondition = "remote-server-not-found"
+	ErrorRemoteServerTimeout   ErrorCondition = "remote-server-timeout"
+	ErrorResourceConstraint    ErrorCondition = "resource-constraint"
+	ErrorServiceUnavailable    ErrorCondition = "service-unavailable"
+	ErrorSubscriptionRequired  ErrorCondition = "subscription-required"
+	ErrorUndefinedCondition    ErrorCondition = "undefined-condition"
+	ErrorUnexpectedRequest     ErrorCondition = "unexpected-request"
+)
+
+var _ error = ErrorItemNotFound
+
+// The type which usually accompanies each condition.
+var errorTypes = map[ErrorCondition]string{
+	ErrorBadRequest:            ErrorTypeModify,
+	ErrorConflict:              ErrorTypeCancel,
+	ErrorFeatureNotImplemented: ErrorTypeCancel,
+	ErrorForbidden:             ErrorTypeAuth,
+	ErrorGone:                  ErrorTypeCancel,
+	ErrorInternalServerError:   ErrorTypeCancel,
+	ErrorItemNotFound:          ErrorTypeCancel,
+	ErrorJidMalformed:          ErrorTypeModify,
+	ErrorNotAcceptable:         ErrorTypeModify,
+	ErrorNotAllowed:            ErrorTypeCancel,
+	ErrorNotAuthorized:         ErrorTypeAuth,
+	ErrorPolicyViolation:       ErrorTypeModify,
+	ErrorRecipientUnavailable:  ErrorTypeWait,
+	ErrorRedirect:              ErrorTypeModify,
+	ErrorRegistrationRequired:  ErrorTypeAuth,
+	ErrorRemoteServerNotFound:  ErrorTypeCancel,
+	ErrorRemoteServerTimeout:   ErrorTypeWait,
+	ErrorResourceConstraint:    ErrorTypeWait,
+	ErrorServiceUnavailable:    ErrorTypeCancel,
+	ErrorSubscriptionRequired:  ErrorTypeAuth,
+	ErrorUndefinedCondition:    ErrorTypeCancel,
+	ErrorUnexpectedRequest:     ErrorTypeWait,
+}
 
 // Used for resource binding as a nested element inside <iq/>.
 type bindIq struct {
@@ -272,13 +399,179 @@ func (u *Generic) String() string {
 		u.XMLName.Local)
 }
 
+// Convert the error as received into the form we give the
+// application. Conditions from outside the streams namespace are
+// treated as undefined-condition.
+func (se *streamError) streamError() *StreamError {
+	err := &StreamError{Condition: StreamUndefinedCondition}
+	if se.Any.XMLName.Space == NsStreams {
+		err.Condition = StreamCondition(se.Any.XMLName.Local)
+	}
+	if err.Condition == StreamSeeOtherHost {
+		err.OtherHost = strings.TrimSpace(se.Any.Chardata)
+	}
+	if se.Text != nil {
+		err.Text = se.Text.Text
+		err.Lang = se.Text.Lang
+	}
+	return err
+}
+
+func (e *StreamError) Error() string {
+	str := "stream error: " + string(e.Condition)
+	if e.Text != "" {
+		str += ": " + e.Text
+	}
+	return str
+}
+
+// Allows errors.Is(err, StreamConflict) and the like.
+func (e *StreamError) Is(target error) bool {
+	cond, ok := target.(StreamCondition)
+	return ok && cond == e.Condition
+}
+
+func (c StreamCondition) Error() string {
+	return string(c)
+}
+
+// Returns a new stanza error with the given condition and the type
+// RFC 6120 suggests for it. The text may be empty.
+func NewError(cond ErrorCondition, text string) *Error {
+	typ, ok := errorTypes[cond]
+	if !ok {
+		typ = ErrorTypeCancel
+	}
+	return &Error{Type: typ, Condition: cond, Text: text}
+}
+
 func (er *Error) Error() string {
-	buf, err := xml.Marshal(er)
-	if err != nil {
-		log.Println("double bad error: couldn't marshal error")
-		return "unreadable error"
+	str := "stanza error: " + string(er.Condition)
+	if er.Text != "" {
+		str += ": " + er.Text
 	}
-	return string(buf)
+	return str
+}
+
+// Allows errors.Is(err, ErrorItemNotFound) and the like.
+func (er *Error) Is(target error) bool {
+	cond, ok := target.(ErrorCondition)
+	return ok && cond == er.Condition
+}
+
+func (c ErrorCondition) Error() string {
+	return string(c)
+}
+
+func (er *Error) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: "error"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "type"},
+			Value: er.Type}}}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	cond := er.Condition
+	if cond == "" {
+		cond = ErrorUndefinedCondition
+	}
+	condElt := xml.StartElement{Name: xml.Name{Space: NsStanzas,
+		Local: string(cond)}}
+	if err := enc.EncodeElement(er.ConditionText, condElt); err != nil {
+		return err
+	}
+	if er.Text != "" {
+		txt := Text{XMLName: xml.Name{Space: NsStanzas, Local: "text"},
+			Lang: er.Lang, Chardata: er.Text}
+		if err := enc.Encode(txt); err != nil {
+			return err
+		}
+	}
+	if er.Any != nil {
+		if err := enc.Encode(er.Any); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// The condition and text are elements in the stanzas namespace; the
+// element from any other namespace is the application-specific
+// condition.
+func (er *Error) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	er.XMLName = start.Name
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "type" {
+			er.Type = attr.Value
+		}
+	}
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t := t.(type) {
+		case xml.EndElement:
+			return nil
+		case xml.StartElement:
+			switch {
+			case t.Name.Space == NsStanzas && t.Name.Local == "text":
+				var txt Text
+				if err := dec.DecodeElement(&txt, &t); err != nil {
+					return err
+				}
+				er.Text = txt.Chardata
+				er.Lang = txt.Lang
+			case t.Name.Space == NsStanzas:
+				var cond Data
+				if err := dec.DecodeElement(&cond, &t); err != nil {
+					return err
+				}
+				er.Condition = ErrorCondition(t.Name.Local)
+				er.ConditionText = cond.Chardata
+			default:
+				er.Any = &Generic{}
+				if err := dec.DecodeElement(er.Any, &t); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// Build the header of a reply to this stanza: addressed back to the
+// sender, with the same id.
+func (h *Header) reply(typ string) Header {
+	return Header{To: h.From, From: h.To, Id: h.Id, Type: typ,
+		Lang: h.Lang}
+}
+
+// Returns a result response to this iq, containing the given
+// elements.
+func (iq *Iq) Reply(nested ...interface{}) *Iq {
+	reply := &Iq{Header: iq.reply("result")}
+	reply.Nested = nested
+	return reply
+}
+
+// Returns an error response to this iq, suitable for sending.
+func (iq *Iq) ErrorReply(er *Error) *Iq {
+	reply := &Iq{Header: iq.reply("error")}
+	reply.Error = er
+	return reply
+}
+
+// Returns an error response to this message, suitable for sending.
+func (m *Message) ErrorReply(er *Error) *Message {
+	reply := &Message{Header: m.reply("error")}
+	reply.Error = er
+	return reply
+}
+
+// Returns an error response to this presence, suitable for sending.
+func (p *Presence) ErrorReply(er *Error) *Presence {
+	reply := &Presence{Header: p.reply("error")}
+	reply.Error = er
+	return reply
 }
 
 var bindExt Extension = Extension{}
@@ -3,6 +3,7 @@ package xmpp
 import (
 	"bytes"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"os"
 	"reflect"
@@ -129,3 +130,97 @@ func TestUnmarshalMessage(t *testing.T) {
 		t.Errorf("body\ngot:  %#v\nwant: %#v\n", obsBody, expBody)
 	}
 }
+
+func TestErrorUnmarshal(t *testing.T) {
+	str := `<iq type="error" id="42" from="pubsub.example.com">` +
+		`<error type="cancel"><item-not-found xmlns="` + NsStanzas +
+		`"/><text xmlns="` + NsStanzas + `" xml:lang="en">` +
+		`No such node</text><bad-node xmlns="urn:example"/>` +
+		`</error></iq>`
+	iq := &Iq{}
+	if err := xml.Unmarshal([]byte(str), iq); err != nil {
+		t.Fatal(err)
+	}
+	er := iq.Error
+	if er == nil {
+		t.Fatal("no error")
+	}
+	assertEquals(t, ErrorTypeCancel, er.Type)
+	assertEquals(t, string(ErrorItemNotFound), string(er.Condition))
+	assertEquals(t, "No such node", er.Text)
+	assertEquals(t, "en", er.Lang)
+	if er.Any == nil {
+		t.Fatal("no application condition")
+	}
+	assertEquals(t, "bad-node", er.Any.XMLName.Local)
+	assertEquals(t, "urn:example", er.Any.XMLName.Space)
+
+	var err error = er
+	if !errors.Is(err, ErrorItemNotFound) {
+		t.Errorf("not item-not-found: %v", err)
+	}
+	if errors.Is(err, ErrorForbidden) {
+		t.Errorf("is forbidden: %v", err)
+	}
+	assertEquals(t, "stanza error: item-not-found: No such node",
+		err.Error())
+	assertEquals(t, "", er.ConditionText)
+}
+
+func TestErrorConditionText(t *testing.T) {
+	str := `<error type="cancel"><gone xmlns="` + NsStanzas +
+		`">xmpp:room@muc.example.com?join</gone></error>`
+	er := &Error{}
+	if err := xml.Unmarshal([]byte(str), er); err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, string(ErrorGone), string(er.Condition))
+	assertEquals(t, "xmpp:room@muc.example.com?join", er.ConditionText)
+	exp := `<error type="cancel"><gone xmlns="` + NsStanzas +
+		`">xmpp:room@muc.example.com?join</gone></error>`
+	assertMarshal(t, exp, er)
+}
+
+func TestErrorMarshal(t *testing.T) {
+	er := NewError(ErrorServiceUnavailable, "")
+	exp := `<error type="cancel"><service-unavailable xmlns="` +
+		NsStanzas + `"></service-unavailable></error>`
+	assertMarshal(t, exp, er)
+
+	er = NewError(ErrorBadRequest, "Missing node")
+	er.Lang = "en"
+	er.Any = &Generic{XMLName: xml.Name{Space: "urn:example",
+		Local: "nodeid-required"}}
+	exp = `<error type="modify"><bad-request xmlns="` + NsStanzas +
+		`"></bad-request><text xmlns="` + NsStanzas +
+		`" xml:lang="en">Missing node</text><nodeid-required` +
+		` xmlns="urn:example"></nodeid-required></error>`
+	assertMarshal(t, exp, er)
+}
+
+func TestErrorReply(t *testing.T) {
+	iq := &Iq{Header: Header{To: "me@example.com/a",
+		From: "you@example.com/b", Id: "x1", Type: "get",
+		Innerxml: `<query xmlns="urn:example"/>`}}
+	reply := iq.ErrorReply(NewError(ErrorFeatureNotImplemented, ""))
+	exp := `<iq to="you@example.com/b" from="me@example.com/a"` +
+		` id="x1" type="error"><error type="cancel">` +
+		`<feature-not-implemented xmlns="` + NsStanzas +
+		`"></feature-not-implemented></error></iq>`
+	assertMarshal(t, exp, reply)
+
+	msg := &Message{Header: Header{To: "me@example.com",
+		From: "you@example.com/b", Id: "m1", Type: "chat"}}
+	mReply := msg.ErrorReply(NewError(ErrorNotAcceptable, ""))
+	assertEquals(t, "you@example.com/b", string(mReply.To))
+	assertEquals(t, "me@example.com", string(mReply.From))
+	assertEquals(t, "m1", mReply.Id)
+	assertEquals(t, "error", mReply.Type)
+
+	pr := &Presence{Header: Header{From: "you@example.com/b",
+		Id: "p1"}}
+	pReply := pr.ErrorReply(NewError(ErrorForbidden, ""))
+	assertEquals(t, "you@example.com/b", string(pReply.To))
+	assertEquals(t, "p1", pReply.Id)
+	assertEquals(t, ErrorTypeAuth, pReply.Error.Type)
+}
@@ -0,0 +1,218 @@
+package xmpp
+
+// This file contains support for managing presence subscriptions,
+// RFC 6121, section 3.
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// How long subscription requests wait for the roster. If it hasn't
+// arrived by then, the requests are delivered as if their senders
+// weren't in any of the automatic groups.
+const subscriptionRosterWait = 30 * time.Second
+
+// Subscriptions handles the subscribe, subscribed, unsubscribe, and
+// unsubscribed presence stanzas. Include its Extension in the list
+// given to NewClient.
+type Subscriptions struct {
+	Extension
+	events    chan<- SubscriptionEvent
+	autoGroup map[string]bool
+	incoming  chan *Presence
+	client    *Client
+	// How long to hold requests waiting for the roster.
+	rosterWait time.Duration
+}
+
+// Something a contact did to a presence subscription. Type is the
+// type of the presence stanza: "subscribe" if the contact asks to see
+// our presence, "subscribed" if they approved our request,
+// "unsubscribe" if they no longer want our presence, or
+// "unsubscribed" if they denied our request or cancelled our
+// subscription.
+type SubscriptionEvent struct {
+	Type     PresenceType
+	From     JID
+	Presence *Presence
+}
+
+// Returned by PreApprove when the server doesn't support it.
+var ErrNoPreApproval = errors.New("server doesn't support subscription pre-approval")
+
+// Creates a subscription manager. Subscription stanzas are delivered
+// on events, rather than Client.Recv, and events must be read
+// promptly. If events is nil, requests which aren't approved
+// automatically are left pending; the server will deliver them again
+// next session. Requests from contacts who are in our roster, in any
+// of autoGroups, are approved without asking.
+func NewSubscriptions(events chan<- SubscriptionEvent,
+	autoGroups []string) *Subscriptions {
+
+	s := &Subscriptions{events: events,
+		rosterWait: subscriptionRosterWait}
+	s.autoGroup = make(map[string]bool)
+	for _, g := range autoGroups {
+		s.autoGroup[g] = true
+	}
+	s.incoming = make(chan *Presence)
+	s.RecvFilter = s.recvFilter
+	s.Init = func(cl *Client) {
+		s.client = cl
+		go s.subscriptionMgr(cl.done)
+	}
+	return s
+}
+
+// Is this one of the presence types we handle?
+func isSubscription(p *Presence) bool {
+	switch PresenceType(p.Type) {
+	case PresenceSubscribe, PresenceSubscribed, PresenceUnsubscribe,
+		PresenceUnsubscribed:
+		return true
+	}
+	return false
+}
+
+// Take subscription stanzas out of the incoming stream.
+func (s *Subscriptions) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for st := range in {
+		p, ok := st.(*Presence)
+		if !ok || !isSubscription(p) {
+			out <- st
+			continue
+		}
+		select {
+		case s.incoming <- p:
+		case <-s.client.done:
+		}
+	}
+}
+
+// Decide what to do about each subscription stanza, and deliver the
+// resulting events in order. Subscription requests wait until the
+// roster has been loaded, so we can tell who's in the auto-approved
+// groups, but not forever: the roster fetch may have failed.
+func (s *Subscriptions) subscriptionMgr(done <-chan struct{}) {
+	roster := s.client.Roster.Subscribe()
+	groups := make(map[JID][]string)
+	loaded := false
+	var held []*Presence
+	var timeout <-chan time.Time
+	var queue []SubscriptionEvent
+	release := func() {
+		loaded = true
+		timeout = nil
+		for _, p := range held {
+			queue = s.handle(p, groups, queue)
+		}
+		held = nil
+	}
+	for {
+		var events chan<- SubscriptionEvent
+		var next SubscriptionEvent
+		if len(queue) > 0 {
+			events = s.events
+			next = queue[0]
+		}
+		select {
+		case <-done:
+			return
+
+		case ev, ok := <-roster:
+			if !ok {
+				return
+			}
+			switch ev.Type {
+			case RosterAdded, RosterUpdated:
+				groups[ev.Item.Jid] = ev.Item.Group
+			case RosterRemoved:
+				delete(groups, ev.Item.Jid)
+			case RosterLoaded:
+				release()
+			}
+
+		case <-timeout:
+			release()
+
+		case p := <-s.incoming:
+			if PresenceType(p.Type) == PresenceSubscribe && !loaded {
+				if held == nil {
+					timeout = time.After(s.rosterWait)
+				}
+				held = append(held, p)
+				continue
+			}
+			queue = s.handle(p, groups, queue)
+
+		case events <- next:
+			queue = queue[1:]
+		}
+	}
+}
+
+// Handle one subscription stanza, and add the event for the
+// application, if any, to queue.
+func (s *Subscriptions) handle(p *Presence, groups map[JID][]string,
+	queue []SubscriptionEvent) []SubscriptionEvent {
+
+	from := p.From.Bare()
+	if PresenceType(p.Type) == PresenceSubscribe {
+		for _, g := range groups[from] {
+			if s.autoGroup[g] {
+				s.send(context.Background(), from,
+					PresenceSubscribed)
+				return queue
+			}
+		}
+	}
+	if s.events == nil {
+		return queue
+	}
+	return append(queue, SubscriptionEvent{Type: PresenceType(p.Type),
+		From:     from,
+		Presence: p})
+}
+
+func (s *Subscriptions) send(ctx context.Context, to JID,
+	typ PresenceType) error {
+
+	p := &Presence{Header: Header{To: to.Bare(), Type: string(typ)}}
+	return s.client.send(ctx, p)
+}
+
+// Ask to see a contact's presence. Their answer arrives as a
+// "subscribed" or "unsubscribed" event.
+func (s *Subscriptions) Subscribe(ctx context.Context, jid JID) error {
+	return s.send(ctx, jid, PresenceSubscribe)
+}
+
+// Stop receiving a contact's presence.
+func (s *Subscriptions) Unsubscribe(ctx context.Context, jid JID) error {
+	return s.send(ctx, jid, PresenceUnsubscribe)
+}
+
+// Let a contact see our presence, in answer to their request.
+func (s *Subscriptions) Approve(ctx context.Context, jid JID) error {
+	return s.send(ctx, jid, PresenceSubscribed)
+}
+
+// Refuse a contact's request to see our presence, or stop them seeing
+// it if they already can.
+func (s *Subscriptions) Deny(ctx context.Context, jid JID) error {
+	return s.send(ctx, jid, PresenceUnsubscribed)
+}
+
+// Approve a contact's subscription request before they make it. The
+// server will then approve it without asking us. Not all servers
+// support this. RFC 6121, section 3.4.
+func (s *Subscriptions) PreApprove(ctx context.Context, jid JID) error {
+	fe := s.client.Features
+	if fe == nil || fe.PreApproval == nil {
+		return ErrNoPreApproval
+	}
+	return s.send(ctx, jid, PresenceSubscribed)
+}
@@ -0,0 +1,88 @@
+package xmpp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSubscriptions(t *testing.T) {
+	cl, recv, sent := newTestClient()
+	defer close(recv)
+	r := newRosterExt()
+	r.client = cl
+	cl.Roster = *r
+	events := make(chan SubscriptionEvent)
+	s := NewSubscriptions(events, []string{"Bots"})
+	s.Init(cl)
+	r.Init(cl)
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	go s.recvFilter(in, out)
+	defer close(in)
+
+	// This has to wait for the roster.
+	in <- &Presence{Header: Header{From: "bot@example.com/x",
+		Type: "subscribe"}}
+	r.update()
+	iq := (<-sent).(*Iq)
+	recv <- iq.Reply(&RosterQuery{Item: []RosterItem{
+		{Jid: "bot@example.com", Group: []string{"Bots"}}}})
+	p := (<-sent).(*Presence)
+	assertEquals(t, "subscribed", p.Type)
+	assertEquals(t, "bot@example.com", string(p.To))
+
+	// Everybody else has to ask.
+	in <- &Presence{Header: Header{From: "you@example.com/a",
+		Type: "subscribe"}}
+	select {
+	case ev := <-events:
+		assertEquals(t, "subscribe", string(ev.Type))
+		assertEquals(t, "you@example.com", string(ev.From))
+	case <-time.After(time.Second):
+		t.Fatal("no subscription event")
+	}
+	select {
+	case st := <-sent:
+		t.Errorf("sent %v", st)
+	default:
+	}
+
+	// Other presence isn't ours.
+	avail := &Presence{Header: Header{From: "you@example.com/a"}}
+	in <- avail
+	if st := <-out; st != avail {
+		t.Errorf("got %v", st)
+	}
+
+	if err := s.PreApprove(context.Background(),
+		"you@example.com"); err != ErrNoPreApproval {
+		t.Errorf("wrong error %v", err)
+	}
+}
+
+func TestSubscriptionsWithoutRoster(t *testing.T) {
+	cl, recv, _ := newTestClient()
+	defer close(recv)
+	r := newRosterExt()
+	r.client = cl
+	cl.Roster = *r
+	events := make(chan SubscriptionEvent)
+	s := NewSubscriptions(events, []string{"Bots"})
+	s.rosterWait = 10 * time.Millisecond
+	s.Init(cl)
+	r.Init(cl)
+	in := make(chan Stanza)
+	go s.recvFilter(in, make(chan Stanza))
+	defer close(in)
+
+	// The roster never arrives, so the request is passed on.
+	in <- &Presence{Header: Header{From: "bot@example.com/x",
+		Type: "subscribe"}}
+	select {
+	case ev := <-events:
+		assertEquals(t, "bot@example.com", string(ev.From))
+	case <-time.After(time.Second):
+		t.Fatal("request still held")
+	}
+}
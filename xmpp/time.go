@@ -0,0 +1,73 @@
+package xmpp
+
+// This file contains support for entity time, XEP-0202.
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+const NsTime = "urn:xmpp:time"
+
+// An entity time query or result.
+type TimeQuery struct {
+	XMLName xml.Name `xml:"urn:xmpp:time time"`
+	// The entity's offset from UTC, as "+hh:mm" or "-hh:mm".
+	Tzo string `xml:"tzo,omitempty"`
+	// The current time in UTC. XEP-0082.
+	Utc string `xml:"utc,omitempty"`
+}
+
+// Creates an extension which tells anybody who asks what time it is
+// here, and in which time zone.
+func NewTimeResponder() Extension {
+	qName := xml.Name{Space: NsTime, Local: "time"}
+	ext := Extension{StanzaTypes: map[xml.Name]reflect.Type{
+		qName: reflect.TypeOf(TimeQuery{})}}
+	ext.Init = func(cl *Client) {
+		cl.Disco.AddFeature(NsTime)
+		cl.HandleIq("get", qName, func(iq *Iq) *Iq {
+			return iq.Reply(newTimeQuery(time.Now()))
+		})
+	}
+	return ext
+}
+
+func newTimeQuery(now time.Time) *TimeQuery {
+	return &TimeQuery{Tzo: now.Format("-07:00"),
+		Utc: now.UTC().Format("2006-01-02T15:04:05.000Z")}
+}
+
+// Returns the time in the entity's own time zone.
+func (q *TimeQuery) Time() (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, q.Utc)
+	if err != nil {
+		return t, err
+	}
+	zone, err := time.Parse("-07:00", q.Tzo)
+	if err != nil {
+		// Some entities send "Z".
+		zone, err = time.Parse("Z07:00", q.Tzo)
+		if err != nil {
+			return t, fmt.Errorf("bad tzo %q", q.Tzo)
+		}
+	}
+	return t.In(zone.Location()), nil
+}
+
+// Ask an entity what time it is there.
+func (cl *Client) QueryTime(ctx context.Context, to JID) (time.Time, error) {
+	reply, err := cl.SendIq(ctx, NewIq(IqGet, to, &TimeQuery{}))
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, ele := range reply.Nested {
+		if q, ok := ele.(*TimeQuery); ok {
+			return q.Time()
+		}
+	}
+	return time.Time{}, fmt.Errorf("no time in reply from %s", to)
+}
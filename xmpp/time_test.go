@@ -0,0 +1,39 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestTimeQuery(t *testing.T) {
+	zone := time.FixedZone("CST", -6*60*60)
+	now := time.Date(2006, 12, 19, 11, 58, 35, 0, zone)
+	q := newTimeQuery(now)
+	assertEquals(t, "-06:00", q.Tzo)
+	assertEquals(t, "2006-12-19T17:58:35.000Z", q.Utc)
+
+	// The example from XEP-0202.
+	str := `<time xmlns="urn:xmpp:time"><tzo>-06:00</tzo>` +
+		`<utc>2006-12-19T17:58:35Z</utc></time>`
+	q = &TimeQuery{}
+	if err := xml.Unmarshal([]byte(str), q); err != nil {
+		t.Fatal(err)
+	}
+	there, err := q.Time()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !there.Equal(now) || there.Hour() != 11 {
+		t.Errorf("got %v", there)
+	}
+
+	q.Tzo = "Z"
+	if there, err = q.Time(); err != nil || there.Hour() != 17 {
+		t.Errorf("got %v, %v", there, err)
+	}
+	q.Tzo = "6 hours west"
+	if _, err = q.Time(); err == nil {
+		t.Error("no error for bad tzo")
+	}
+}
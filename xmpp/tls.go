@@ -0,0 +1,162 @@
+// Verification of the server's certificate. XMPP servers may identify
+// themselves with a DNS-ID, an SRV-ID, or an XmppAddr. See RFC 6125
+// and RFC 7590.
+
+package xmpp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	// id-on-xmppAddr, RFC 6120 section 13.7.1.4.
+	oidXmppAddr = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 8, 5}
+	// id-on-dnsSRV, RFC 4985.
+	oidSrvName = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 8, 7}
+)
+
+// An otherName from a subjectAltName extension, minus its implicit
+// [0] tag. The value is still wrapped in its explicit [0] tag.
+type otherName struct {
+	TypeId asn1.ObjectIdentifier
+	Value  asn1.RawValue
+}
+
+// Build the TLS configuration used to talk to the given domain. The
+// server name defaults to the domain of our JID, not to the host we
+// connected to, so that SRV redirection can't be used to substitute a
+// different certificate. Unless the application has disabled
+// verification, we do it ourselves, since crypto/tls doesn't know
+// about XMPP identities.
+func (cl *Client) tlsConfigFor(domain string) *tls.Config {
+	conf := cl.tlsConfig.Clone()
+	if conf.ServerName == "" {
+		conf.ServerName = domain
+	}
+	if conf.InsecureSkipVerify {
+		return conf
+	}
+	conf.InsecureSkipVerify = true
+	next := conf.VerifyConnection
+	conf.VerifyConnection = func(cs tls.ConnectionState) error {
+		chain, err := verifyXmppCert(cs.PeerCertificates,
+			conf.ServerName, conf)
+		if err != nil {
+			return err
+		}
+		cs.VerifiedChains = [][]*x509.Certificate{chain}
+		cl.VerifiedChain = chain
+		if next != nil {
+			return next(cs)
+		}
+		return nil
+	}
+	return conf
+}
+
+// Check the certificates presented by the server against the roots
+// in conf, and make sure the leaf is valid for the XMPP domain. The
+// verified chain is returned.
+func verifyXmppCert(certs []*x509.Certificate, domain string,
+	conf *tls.Config) ([]*x509.Certificate, error) {
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate from %s", domain)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         conf.RootCAs,
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   time.Now(),
+	}
+	if conf.Time != nil {
+		opts.CurrentTime = conf.Time()
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	chains, err := certs[0].Verify(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyXmppIdentity(certs[0], domain); err != nil {
+		return nil, err
+	}
+	return chains[0], nil
+}
+
+// Does the certificate identify the given XMPP domain? We accept a
+// DNS-ID, an SRV-ID for the xmpp-client service, or an XmppAddr
+// which is exactly the domain.
+func verifyXmppIdentity(cert *x509.Certificate, domain string) error {
+	if cert.VerifyHostname(domain) == nil {
+		return nil
+	}
+	xmppAddrs, srvNames := otherNames(cert)
+	for _, addr := range xmppAddrs {
+		if strings.EqualFold(addr, domain) {
+			return nil
+		}
+	}
+	srvId := "_" + clientSrv + "." + domain
+	for _, name := range srvNames {
+		if strings.EqualFold(name, srvId) {
+			return nil
+		}
+	}
+	return x509.HostnameError{Certificate: cert, Host: domain}
+}
+
+// Extract the XmppAddr and SRVName identities from the certificate's
+// subjectAltName. crypto/x509 doesn't parse otherName entries, so we
+// do it here. Malformed entries are skipped.
+func otherNames(cert *x509.Certificate) (xmppAddrs, srvNames []string) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+		var seq asn1.RawValue
+		rest, err := asn1.Unmarshal(ext.Value, &seq)
+		if err != nil || len(rest) != 0 || !seq.IsCompound {
+			return
+		}
+		rest = seq.Bytes
+		for len(rest) > 0 {
+			var gn asn1.RawValue
+			rest, err = asn1.Unmarshal(rest, &gn)
+			if err != nil {
+				return
+			}
+			// otherName is [0] in GeneralName.
+			if gn.Class != asn1.ClassContextSpecific ||
+				gn.Tag != 0 {
+				continue
+			}
+			var on otherName
+			_, err = asn1.UnmarshalWithParams(gn.FullBytes, &on,
+				"tag:0")
+			if err != nil {
+				continue
+			}
+			var val asn1.RawValue
+			_, err = asn1.Unmarshal(on.Value.Bytes, &val)
+			if err != nil {
+				continue
+			}
+			switch {
+			case on.TypeId.Equal(oidXmppAddr) &&
+				val.Tag == asn1.TagUTF8String:
+				xmppAddrs = append(xmppAddrs, string(val.Bytes))
+			case on.TypeId.Equal(oidSrvName) &&
+				val.Tag == asn1.TagIA5String:
+				srvNames = append(srvNames, string(val.Bytes))
+			}
+		}
+	}
+	return
+}
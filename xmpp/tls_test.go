@@ -0,0 +1,163 @@
+package xmpp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// Encode an otherName GeneralName holding a string of the given tag.
+func marshalOtherName(t *testing.T, oid asn1.ObjectIdentifier, tag int,
+	val string) []byte {
+
+	inner, err := asn1.Marshal(asn1.RawValue{Tag: tag,
+		Bytes: []byte(val)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	on, err := asn1.Marshal(otherName{TypeId: oid,
+		Value: asn1.RawValue{Class: asn1.ClassContextSpecific,
+			IsCompound: true, Bytes: inner}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replace the SEQUENCE tag with the implicit [0].
+	var seq asn1.RawValue
+	asn1.Unmarshal(on, &seq)
+	gn, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific,
+		IsCompound: true, Bytes: seq.Bytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gn
+}
+
+// Make a self-signed certificate with the given otherName entries in
+// its subjectAltName.
+func makeCert(t *testing.T, names ...[]byte) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var san []byte
+	for _, n := range names {
+		san = append(san, n...)
+	}
+	sanDer, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence,
+		IsCompound: true, Bytes: san})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign |
+			x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtraExtensions: []pkix.Extension{{Id: oidSubjectAltName,
+			Value: sanDer}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestOtherNames(t *testing.T) {
+	cert := makeCert(t,
+		marshalOtherName(t, oidXmppAddr, asn1.TagUTF8String,
+			"example.com"),
+		marshalOtherName(t, oidSrvName, asn1.TagIA5String,
+			"_xmpp-client.example.net"))
+	addrs, srvs := otherNames(cert)
+	if len(addrs) != 1 || len(srvs) != 1 {
+		t.Fatalf("got %v %v", addrs, srvs)
+	}
+	assertEquals(t, "example.com", addrs[0])
+	assertEquals(t, "_xmpp-client.example.net", srvs[0])
+}
+
+func TestVerifyXmppIdentity(t *testing.T) {
+	cert := makeCert(t,
+		marshalOtherName(t, oidXmppAddr, asn1.TagUTF8String,
+			"example.com"),
+		marshalOtherName(t, oidSrvName, asn1.TagIA5String,
+			"_xmpp-client.example.net"))
+	for _, domain := range []string{"example.com", "EXAMPLE.net"} {
+		if err := verifyXmppIdentity(cert, domain); err != nil {
+			t.Errorf("%s: %v", domain, err)
+		}
+	}
+	for _, domain := range []string{"example.org", "sub.example.com"} {
+		if err := verifyXmppIdentity(cert, domain); err == nil {
+			t.Errorf("%s: no error", domain)
+		}
+	}
+
+	// The SRV-ID is only good for the xmpp-client service.
+	cert = makeCert(t, marshalOtherName(t, oidSrvName,
+		asn1.TagIA5String, "_xmpp-server.example.com"))
+	if err := verifyXmppIdentity(cert, "example.com"); err == nil {
+		t.Errorf("accepted xmpp-server SRV-ID")
+	}
+}
+
+func TestVerifyXmppCert(t *testing.T) {
+	cert := makeCert(t, marshalOtherName(t, oidXmppAddr,
+		asn1.TagUTF8String, "example.com"))
+	conf := &tls.Config{RootCAs: x509.NewCertPool()}
+	_, err := verifyXmppCert([]*x509.Certificate{cert}, "example.com",
+		conf)
+	if err == nil {
+		t.Fatal("accepted untrusted cert")
+	}
+
+	conf.RootCAs.AddCert(cert)
+	chain, err := verifyXmppCert([]*x509.Certificate{cert},
+		"example.com", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 1 || chain[0] != cert {
+		t.Errorf("wrong chain %v", chain)
+	}
+	_, err = verifyXmppCert([]*x509.Certificate{cert}, "example.org",
+		conf)
+	if err == nil {
+		t.Error("accepted cert for wrong domain")
+	}
+}
+
+func TestTlsServerName(t *testing.T) {
+	cl := &Client{}
+	conf := cl.tlsConfigFor("example.com")
+	assertEquals(t, "example.com", conf.ServerName)
+	if conf.VerifyConnection == nil {
+		t.Error("no verification")
+	}
+
+	cl.tlsConfig.ServerName = "other.example.com"
+	cl.tlsConfig.InsecureSkipVerify = true
+	conf = cl.tlsConfigFor("example.com")
+	assertEquals(t, "other.example.com", conf.ServerName)
+	if conf.VerifyConnection != nil {
+		t.Error("verification despite InsecureSkipVerify")
+	}
+}
@@ -0,0 +1,53 @@
+package xmpp
+
+// This file contains support for software version queries, XEP-0092.
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+)
+
+const NsVersion = "jabber:iq:version"
+
+// A software version query or result.
+type VersionQuery struct {
+	XMLName xml.Name `xml:"jabber:iq:version query"`
+	Name    string   `xml:"name,omitempty"`
+	Version string   `xml:"version,omitempty"`
+	Os      string   `xml:"os,omitempty"`
+}
+
+// Creates an extension which tells anybody who asks what software
+// we're running. The operating system is optional; some people would
+// rather not reveal it.
+func NewVersionResponder(name, version, os string) Extension {
+	qName := xml.Name{Space: NsVersion, Local: "query"}
+	ext := Extension{StanzaTypes: map[xml.Name]reflect.Type{
+		qName: reflect.TypeOf(VersionQuery{})}}
+	ext.Init = func(cl *Client) {
+		cl.Disco.AddFeature(NsVersion)
+		cl.HandleIq("get", qName, func(iq *Iq) *Iq {
+			return iq.Reply(&VersionQuery{Name: name,
+				Version: version, Os: os})
+		})
+	}
+	return ext
+}
+
+// Ask an entity what software it's running.
+func (cl *Client) QueryVersion(ctx context.Context,
+	to JID) (*VersionQuery, error) {
+
+	reply, err := cl.SendIq(ctx, NewIq(IqGet, to, &VersionQuery{}))
+	if err != nil {
+		return nil, err
+	}
+	for _, ele := range reply.Nested {
+		if q, ok := ele.(*VersionQuery); ok {
+			return q, nil
+		}
+	}
+	return nil, fmt.Errorf("no version in reply from %s", to)
+}
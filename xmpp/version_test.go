@@ -0,0 +1,44 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+)
+
+func TestVersionResponder(t *testing.T) {
+	cl, recv, sent := newTestClient()
+	defer close(recv)
+	cl.Disco = newDisco()
+	ext := NewVersionResponder("bot", "1.2", "")
+	ext.Init(cl)
+	if !cl.Disco.LocalInfo().HasFeature(NsVersion) {
+		t.Error("feature not advertised")
+	}
+
+	h := cl.iqHandler("get", xml.Name{Space: NsVersion, Local: "query"})
+	req := &Iq{Header: Header{From: "you@example.com/a", Id: "1",
+		Type: "get"}}
+	req.Nested = []interface{}{&VersionQuery{}}
+	exp := `<iq to="you@example.com/a" id="1" type="result"><query` +
+		` xmlns="jabber:iq:version"><name>bot</name>` +
+		`<version>1.2</version></query></iq>`
+	assertMarshal(t, exp, h(req))
+
+	ch := make(chan *VersionQuery)
+	go func() {
+		q, err := cl.QueryVersion(context.Background(),
+			"you@example.com/a")
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- q
+	}()
+	iq := (<-sent).(*Iq)
+	reply := iq.Reply(&VersionQuery{Name: "other", Version: "3"})
+	reply.From = iq.To
+	recv <- reply
+	if q := <-ch; q == nil || q.Name != "other" {
+		t.Errorf("got %v", q)
+	}
+}
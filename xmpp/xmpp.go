@@ -8,11 +8,14 @@ package xmpp
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"net"
 	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -26,13 +29,23 @@ const (
 	NsStream  = "http://etherx.jabber.org/streams"
 	NsTLS     = "urn:ietf:params:xml:ns:xmpp-tls"
 	NsSASL    = "urn:ietf:params:xml:ns:xmpp-sasl"
+	NsStanzas = "urn:ietf:params:xml:ns:xmpp-stanzas"
 	NsBind    = "urn:ietf:params:xml:ns:xmpp-bind"
 	NsSession = "urn:ietf:params:xml:ns:xmpp-session"
 	NsRoster  = "jabber:iq:roster"
+	// XEP-0237 roster versioning stream feature.
+	NsRosterVer = "urn:xmpp:features:rosterver"
 
 	// DNS SRV names
 	serverSrv = "xmpp-server"
 	clientSrv = "xmpp-client"
+
+	// Port to use when a redirect doesn't specify one.
+	clientPort = 5222
+
+	// How many see-other-host redirects we'll follow while
+	// connecting.
+	maxRedirects = 5
 )
 
 // A filter can modify the XMPP traffic to or from the remote
@@ -52,6 +65,10 @@ type Extension struct {
 	// intercepts messages going the other direction.
 	RecvFilter Filter
 	SendFilter Filter
+	// If non-nil, will be called once with the new Client before
+	// the stream is negotiated. An extension can keep the Client
+	// for later use, and register its iq handlers here.
+	Init func(cl *Client)
 }
 
 // The client in a client-server XMPP connection.
@@ -62,13 +79,18 @@ type Client struct {
 	saslExpected string
 	authDone     bool
 	handlers     chan *callback
+	idGenerator  func() string
+	rosterStore  RosterStore
+	// Whether to follow redirects mid-session.
+	followRedirects bool
 	// Incoming XMPP stanzas from the remote will be published on
 	// this channel. Information which is used by this library to
 	// set up the XMPP stream will not appear here.
 	Recv <-chan Stanza
 	// Outgoing XMPP stanzas to the server should be sent to this
 	// channel. The application should not close this channel;
-	// rather, call Close().
+	// rather, call Close(). Stanzas which fail Validate are
+	// dropped; SendStanza reports why.
 	Send    chan<- Stanza
 	sendRaw chan<- interface{}
 	statmgr *statmgr
@@ -76,29 +98,72 @@ type Client struct {
 	// the set of contacts which are known to this JID, or which
 	// this JID is known to.
 	Roster Roster
+	// Answers service discovery queries, and makes them.
+	Disco *Disco
 	// Features advertised by the remote.
-	Features                     *Features
+	Features *Features
+	// The server's certificate chain, as verified when TLS was
+	// negotiated. This is nil if TLS wasn't used or if the
+	// application disabled verification.
+	VerifiedChain                []*x509.Certificate
 	sendFilterAdd, recvFilterAdd chan Filter
 	tlsConfig                    tls.Config
 	layer1                       *layer1
-	error                        chan error
-	shutdownOnce                 sync.Once
+	extStanza                    map[xml.Name]reflect.Type
+	iqLock                       sync.Mutex
+	iqHandlers                   map[iqRoute]IqHandler
+	iqOrdered                    map[iqRoute]bool
+	// The XML writers of new connections, when we're redirected.
+	sendConns chan chan<- interface{}
+	presLock  sync.Mutex
+	presence  *Presence
+	// Closed when the stream has ended.
+	done         chan struct{}
+	errLock      sync.Mutex
+	err          error
+	shutdownOnce sync.Once
+	// Held for reading while our own sends are in progress.
+	sendLock sync.RWMutex
+}
+
+// Settings for a new Client that aren't needed by most applications.
+// They are read once, before the client starts.
+type ClientOptions struct {
+	// If non-nil, generates the ids for stanzas sent by the client
+	// and its extensions, instead of NextId. Tests can use this
+	// to get predictable ids. It's called from many goroutines at
+	// once, so it must be safe for concurrent use.
+	IdGenerator func() string
+	// If non-nil, the roster is saved here, and when the server
+	// supports roster versioning only the changes since then are
+	// fetched at the start of the next session.
+	RosterStore RosterStore
+	// If true, a see-other-host redirect once the session is
+	// running is followed: the client connects to the new host,
+	// authenticates again, and carries on. This means keeping the
+	// password in memory for as long as the client runs.
+	// Otherwise the password is forgotten once resource binding is
+	// done, and such a redirect ends the client with a
+	// *StreamError naming the other host.
+	FollowRedirects bool
 }
 
 // Creates an XMPP client identified by the given JID, authenticating
 // with the provided password and TLS config. Zero or more extensions
-// may be specified. The initial presence will be broadcast. If status
-// is non-nil, connection progress information will be sent on it.
+// may be specified, and opts may be nil. The initial presence will be
+// broadcast. If status is non-nil, connection progress information
+// will be sent on it.
 func NewClient(jid *JID, password string, tlsconf tls.Config, exts []Extension,
-	pr Presence, status chan<- Status) (*Client, error) {
+	opts *ClientOptions, pr Presence, status chan<- Status) (*Client,
+	error) {
 
 	// Resolve the domain in the JID.
 	_, srvs, err := net.LookupSRV(clientSrv, "tcp", jid.Domain())
 	if err != nil {
-		return nil, fmt.Errorf("LookupSrv %s: %v", jid.Domain, err)
+		return nil, fmt.Errorf("LookupSrv %s: %v", jid.Domain(), err)
 	}
 	if len(srvs) == 0 {
-		return nil, fmt.Errorf("LookupSrv %s: no results", jid.Domain)
+		return nil, fmt.Errorf("LookupSrv %s: no results", jid.Domain())
 	}
 
 	var tcp *net.TCPConn
@@ -120,46 +185,237 @@ func NewClient(jid *JID, password string, tlsconf tls.Config, exts []Extension,
 		return nil, err
 	}
 
-	return newClient(tcp, jid, password, tlsconf, exts, pr, status)
+	return newClient(tcp, jid, password, tlsconf, exts, opts, pr, status)
 }
 
 // Connect to the specified host and port. This is otherwise identical
 // to NewClient.
 func NewClientFromHost(jid *JID, password string, tlsconf tls.Config,
-	exts []Extension, pr Presence, status chan<- Status, host string,
-	port int) (*Client, error) {
+	exts []Extension, opts *ClientOptions, pr Presence,
+	status chan<- Status, host string, port int) (*Client, error) {
 
-	addrStr := fmt.Sprintf("%s:%d", host, port)
-	addr, err := net.ResolveTCPAddr("tcp", addrStr)
+	tcp, err := dialTcp(net.JoinHostPort(host, strconv.Itoa(port)))
 	if err != nil {
 		return nil, err
 	}
-	tcp, err := net.DialTCP("tcp", nil, addr)
+
+	return newClient(tcp, jid, password, tlsconf, exts, opts, pr, status)
+}
+
+func dialTcp(addrStr string) (*net.TCPConn, error) {
+	addr, err := net.ResolveTCPAddr("tcp", addrStr)
 	if err != nil {
 		return nil, err
 	}
-
-	return newClient(tcp, jid, password, tlsconf, exts, pr, status)
+	return net.DialTCP("tcp", nil, addr)
 }
 
+// Start a session over the given connection. If the server redirects
+// us with see-other-host (RFC 6120, section 4.9.3.19), connect to the
+// new host and start over. The application sees only the status
+// changes of the connection that finally succeeds or fails. Redirects
+// after the session has started are followed by recvStream, which
+// keeps the same Client.
 func newClient(tcp *net.TCPConn, jid *JID, password string, tlsconf tls.Config,
-	exts []Extension, pr Presence, status chan<- Status) (*Client, error) {
+	exts []Extension, opts *ClientOptions, pr Presence,
+	status chan<- Status) (*Client, error) {
+
+	seen := make(map[string]bool)
+	for redirects := 0; ; redirects++ {
+		seen[tcp.RemoteAddr().String()] = true
+		var stat chan Status
+		final := make(chan bool, 1)
+		if status != nil {
+			stat = make(chan Status)
+			go forwardStatus(stat, status, final)
+		}
+
+		cl, err := startClient(tcp, jid, password, tlsconf, exts, opts,
+			pr, stat)
+		se, ok := err.(*StreamError)
+		if !ok || se.Condition != StreamSeeOtherHost {
+			final <- true
+			return cl, err
+		}
+		final <- false
+
+		if redirects == maxRedirects {
+			return nil, fmt.Errorf("too many redirects: %v", err)
+		}
+		addrStr := redirectAddr(se.OtherHost)
+		tcp, err = dialTcp(addrStr)
+		if err != nil {
+			return nil, fmt.Errorf("redirect to %s: %v", addrStr,
+				err)
+		}
+		if seen[tcp.RemoteAddr().String()] {
+			tcp.Close()
+			return nil, fmt.Errorf("redirect loop at %s", addrStr)
+		}
+	}
+}
+
+// Start the transport and the XML reader and writer for a connection
+// to the server.
+func (cl *Client) startConn(sock net.Conn) (<-chan interface{},
+	chan<- interface{}) {
+
+	recvReader, recvWriter := io.Pipe()
+	sendReader, sendWriter := io.Pipe()
+	cl.layer1 = cl.startLayer1(sock, recvWriter, sendReader,
+		cl.statmgr.newListener())
+	recvXmlCh := make(chan interface{})
+	go cl.recvXml(recvReader, recvXmlCh, cl.extStanza)
+	sendXmlCh := make(chan interface{})
+	go cl.sendXml(sendWriter, sendXmlCh)
+	return recvXmlCh, sendXmlCh
+}
+
+// Pass outgoing XMLish structures on to the XML writer of the current
+// connection. When the server sends us to another host, the new
+// connection's writer arrives on conns and the old one is closed.
+func switchXml(in <-chan interface{}, out chan<- interface{},
+	conns <-chan chan<- interface{}) {
+
+	defer func() { close(out) }()
+	for {
+		select {
+		case x, ok := <-in:
+			if !ok {
+				return
+			}
+			out <- x
+		case c := <-conns:
+			close(out)
+			out = c
+		}
+	}
+}
+
+// Follow a see-other-host redirect that arrived once the session was
+// under way: connect to the new host, and carry on with the same
+// Client once a stream has been negotiated there. Returns the
+// channel that the new connection's XMLish structures arrive on.
+func (cl *Client) redirect(host string, seen map[string]bool) (
+	<-chan interface{}, error) {
+
+	addrStr := redirectAddr(host)
+	tcp, err := dialTcp(addrStr)
+	if err != nil {
+		return nil, fmt.Errorf("redirect to %s: %v", addrStr, err)
+	}
+	if seen[tcp.RemoteAddr().String()] {
+		tcp.Close()
+		return nil, fmt.Errorf("redirect loop at %s", addrStr)
+	}
+	seen[tcp.RemoteAddr().String()] = true
+
+	cl.setStatus(StatusRedirected)
+	cl.setStatus(StatusConnected)
+	cl.layer1.retire()
+	recvXmlCh, sendXmlCh := cl.startConn(tcp)
+	cl.sendConns <- sendXmlCh
+	cl.Features = nil
+	cl.saslExpected = ""
+	cl.sendRaw <- &stream{To: cl.Jid.Domain(), Version: XMPPVersion}
+	go cl.resumeSession()
+	return recvXmlCh, nil
+}
+
+// Once resource binding is done on the new host, start the session
+// there, let the server know our presence again, and refresh the
+// roster.
+func (cl *Client) resumeSession() {
+	if err := cl.statmgr.awaitStatus(StatusBound); err != nil {
+		return
+	}
+	if err := cl.startSession(); err != nil {
+		cl.setError(err)
+		return
+	}
+	if pr := cl.lastPresence(); pr != nil {
+		cl.sendRaw <- pr
+	}
+	cl.setStatus(StatusRunning)
+	cl.Roster.update()
+}
+
+// Start the session, after resource binding. RFC 3921, section 3.
+func (cl *Client) startSession() error {
+	id := cl.NextId()
+	iq := &Iq{Header: Header{To: JID(cl.Jid.Domain()), Id: id, Type: "set",
+		Nested: []interface{}{Generic{XMLName: xml.Name{Space: NsSession, Local: "session"}}}}}
+	ch := make(chan error, 1)
+	f := func(st Stanza) {
+		iq, ok := st.(*Iq)
+		if !ok {
+			ch <- fmt.Errorf("bad session start reply: %#v", st)
+			return
+		}
+		if iq.Type == "error" {
+			ch <- fmt.Errorf("Can't start session: %v", iq.Error)
+			return
+		}
+		ch <- nil
+	}
+	cl.SetReplyCallback(id, iq.To, f)
+	cl.sendRaw <- iq
+	// Now wait until the callback is called.
+	select {
+	case err := <-ch:
+		return err
+	case <-cl.done:
+		return errShutdown
+	}
+}
+
+// The presence we most recently broadcast, to be sent again if we're
+// redirected to another host.
+func (cl *Client) lastPresence() *Presence {
+	cl.presLock.Lock()
+	defer cl.presLock.Unlock()
+	return cl.presence
+}
+
+// Turn the host from a see-other-host error into something we can
+// dial. It may be a domain name or an IP address, with or without a
+// port; IPv6 addresses are in brackets.
+func redirectAddr(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"),
+		strconv.Itoa(clientPort))
+}
+
+func startClient(tcp *net.TCPConn, jid *JID, password string, tlsconf tls.Config,
+	exts []Extension, opts *ClientOptions, pr Presence,
+	status chan<- Status) (*Client, error) {
 
 	// Include the mandatory extensions.
 	roster := newRosterExt()
 	exts = append(exts, roster.Extension)
+	disco := newDisco()
+	exts = append(exts, disco.Extension)
 	exts = append(exts, bindExt)
 
 	cl := new(Client)
+	roster.client = cl
 	cl.Roster = *roster
+	cl.Disco = disco
 	cl.password = password
 	cl.Jid = *jid
 	cl.handlers = make(chan *callback, 100)
+	cl.done = make(chan struct{})
 	cl.tlsConfig = tlsconf
 	cl.sendFilterAdd = make(chan Filter)
 	cl.recvFilterAdd = make(chan Filter)
 	cl.statmgr = newStatmgr(status)
-	cl.error = make(chan error, 1)
+	if opts != nil {
+		cl.idGenerator = opts.IdGenerator
+		cl.rosterStore = opts.RosterStore
+		cl.followRedirects = opts.FollowRedirects
+	}
 
 	extStanza := make(map[xml.Name]reflect.Type)
 	for _, ext := range exts {
@@ -176,25 +432,21 @@ func newClient(tcp *net.TCPConn, jid *JID, password string, tlsconf tls.Config,
 	// can signal that it's connected.
 	cl.setStatus(StatusConnected)
 
-	// Start the transport handler, initially unencrypted.
-	recvReader, recvWriter := io.Pipe()
-	sendReader, sendWriter := io.Pipe()
-	cl.layer1 = cl.startLayer1(tcp, recvWriter, sendReader,
-		cl.statmgr.newListener())
-
-	// Start the reader and writer that convert to and from XML.
-	recvXmlCh := make(chan interface{})
-	go cl.recvXml(recvReader, recvXmlCh, extStanza)
-	sendXmlCh := make(chan interface{})
-	cl.sendRaw = sendXmlCh
-	go cl.sendXml(sendWriter, sendXmlCh)
+	// Start the transport handler, initially unencrypted, and the
+	// reader and writer that convert to and from XML.
+	cl.extStanza = extStanza
+	recvXmlCh, sendXmlCh := cl.startConn(tcp)
+	sendRawCh := make(chan interface{})
+	cl.sendRaw = sendRawCh
+	cl.sendConns = make(chan chan<- interface{})
+	go switchXml(sendRawCh, sendXmlCh, cl.sendConns)
 
 	// Start the reader and writer that convert between XML and
 	// XMPP stanzas.
 	recvRawXmpp := make(chan Stanza)
 	go cl.recvStream(recvXmlCh, recvRawXmpp, cl.statmgr.newListener())
 	sendRawXmpp := make(chan Stanza)
-	go sendStream(sendXmlCh, sendRawXmpp, cl.statmgr.newListener())
+	go cl.sendStream(sendRawCh, sendRawXmpp, cl.statmgr.newListener())
 
 	// Start the managers for the filters that can modify what the
 	// app sees or sends.
@@ -209,6 +461,14 @@ func newClient(tcp *net.TCPConn, jid *JID, password string, tlsconf tls.Config,
 		cl.AddRecvFilter(ext.RecvFilter)
 		cl.AddSendFilter(ext.SendFilter)
 	}
+	// Incoming requests are routed to their handlers after all
+	// the other filters have seen them.
+	cl.AddRecvFilter(cl.routeIq)
+	for _, ext := range exts {
+		if ext.Init != nil {
+			ext.Init(cl)
+		}
+	}
 
 	// Initial handshake.
 	hsOut := &stream{To: jid.Domain(), Version: XMPPVersion}
@@ -219,28 +479,13 @@ func newClient(tcp *net.TCPConn, jid *JID, password string, tlsconf tls.Config,
 		return nil, cl.getError(err)
 	}
 
-	// Forget about the password, for paranoia's sake.
-	cl.password = ""
-
-	// Initialize the session.
-	id := NextId()
-	iq := &Iq{Header: Header{To: JID(cl.Jid.Domain()), Id: id, Type: "set",
-		Nested: []interface{}{Generic{XMLName: xml.Name{Space: NsSession, Local: "session"}}}}}
-	ch := make(chan error)
-	f := func(st Stanza) {
-		iq, ok := st.(*Iq)
-		if !ok {
-			ch <- fmt.Errorf("bad session start reply: %#v", st)
-		}
-		if iq.Type == "error" {
-			ch <- fmt.Errorf("Can't start session: %v", iq.Error)
-		}
-		ch <- nil
+	// Forget about the password, for paranoia's sake, unless we
+	// may have to authenticate again on another host.
+	if !cl.followRedirects {
+		cl.password = ""
 	}
-	cl.SetCallback(id, f)
-	cl.sendRaw <- iq
-	// Now wait until the callback is called.
-	if err := <-ch; err != nil {
+
+	if err := cl.startSession(); err != nil {
 		return nil, cl.getError(err)
 	}
 
@@ -260,38 +505,48 @@ func (cl *Client) Close() {
 	// Shuts down the receivers:
 	cl.setStatus(StatusShutdown)
 
-	// Shuts down the senders:
-	cl.shutdownOnce.Do(func() { close(cl.Send) })
+	// Shuts down the senders, once nothing can be waiting to
+	// send:
+	cl.shutdownOnce.Do(func() {
+		go func() {
+			<-cl.done
+			cl.sendLock.Lock()
+			defer cl.sendLock.Unlock()
+			close(cl.Send)
+		}()
+	})
 }
 
-// If there's a buffered error in the channel, return it. Otherwise,
-// return what was passed to us. The idea is that the error in the
-// channel probably preceded (and caused) the one that's passed as an
-// argument here.
+// Returns the error which ended the session, or nil if there hasn't
+// been one. If the server closed the stream with an error, this will
+// be a *StreamError; applications can use its Condition to decide
+// whether to reconnect.
+func (cl *Client) Err() error {
+	cl.errLock.Lock()
+	defer cl.errLock.Unlock()
+	return cl.err
+}
+
+// If an error has been registered, return it. Otherwise, return what
+// was passed to us. The idea is that the registered error probably
+// preceded (and caused) the one that's passed as an argument here.
 func (cl *Client) getError(err1 error) error {
-	select {
-	case err0 := <-cl.error:
+	if err0 := cl.Err(); err0 != nil {
 		return err0
-	default:
-		return err1
 	}
+	return err1
 }
 
 // Register an error that happened in the internals somewhere. If
-// there's already an error in the channel, discard the newer one in
-// favor of the older.
+// there's already an error registered, discard the newer one in favor
+// of the older.
 func (cl *Client) setError(err error) {
 	defer cl.Close()
 	defer cl.setStatus(StatusError)
 
-	if len(cl.error) > 0 {
-		return
-	}
-	// If we're in a race between two calls to this function,
-	// trying to set the "first" error, just arbitrarily let one
-	// of them win.
-	select {
-	case cl.error <- err:
-	default:
+	cl.errLock.Lock()
+	defer cl.errLock.Unlock()
+	if cl.err == nil {
+		cl.err = err
 	}
 }
@@ -2,11 +2,17 @@ package xmpp
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"reflect"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestReadError(t *testing.T) {
@@ -99,3 +105,258 @@ func TestWriteStream(t *testing.T) {
 		` from="bar.com" id="42" xml:lang="en" version="1.0">`
 	assertEquals(t, exp, str)
 }
+
+func TestReadSeeOtherHost(t *testing.T) {
+	r := strings.NewReader(`<stream:error><see-other-host xmlns="` +
+		NsStreams + `">[2001:db8::1]:9222</see-other-host>` +
+		`</stream:error></stream:stream>`)
+	ch := make(chan interface{})
+	cl := &Client{}
+	go cl.recvXml(r, ch, make(map[xml.Name]reflect.Type))
+	x := <-ch
+	se, ok := x.(*streamError)
+	if !ok {
+		t.Fatalf("not StreamError: %T", x)
+	}
+	err := se.streamError()
+	if err.Condition != StreamSeeOtherHost {
+		t.Errorf("condition %s", err.Condition)
+	}
+	assertEquals(t, "[2001:db8::1]:9222", err.OtherHost)
+	if _, ok := <-ch; ok {
+		t.Error("kept reading after stream error")
+	}
+}
+
+func TestStreamErrorCondition(t *testing.T) {
+	se := &streamError{Any: Generic{XMLName: xml.Name{Space: NsStreams,
+		Local: "conflict"}}, Text: &errText{Lang: "en",
+		Text: "Replaced by new connection"}}
+	var err error = se.streamError()
+	if !errors.Is(err, StreamConflict) {
+		t.Errorf("not conflict: %v", err)
+	}
+	if errors.Is(err, StreamSystemShutdown) {
+		t.Errorf("is system-shutdown: %v", err)
+	}
+	var e *StreamError
+	if !errors.As(err, &e) {
+		t.Fatalf("not StreamError: %T", err)
+	}
+	assertEquals(t, "Replaced by new connection", e.Text)
+	assertEquals(t, "en", e.Lang)
+	assertEquals(t, "", e.OtherHost)
+	assertEquals(t, "stream error: conflict: Replaced by new connection",
+		err.Error())
+
+	se = &streamError{Any: Generic{XMLName: xml.Name{Space: "blah",
+		Local: "bad-foo"}}}
+	if c := se.streamError().Condition; c != StreamUndefinedCondition {
+		t.Errorf("condition %s", c)
+	}
+}
+
+func TestRedirectAddr(t *testing.T) {
+	assertEquals(t, "other.example.com:5222",
+		redirectAddr("other.example.com"))
+	assertEquals(t, "other.example.com:9222",
+		redirectAddr("other.example.com:9222"))
+	assertEquals(t, "192.0.2.1:5222", redirectAddr("192.0.2.1"))
+	assertEquals(t, "[2001:db8::1]:5222", redirectAddr("[2001:db8::1]"))
+	assertEquals(t, "[2001:db8::1]:9222",
+		redirectAddr("[2001:db8::1]:9222"))
+}
+
+func TestReadStreamEnd(t *testing.T) {
+	read := func(end string, closeErr error) error {
+		cl := &Client{Send: make(chan Stanza)}
+		cl.statmgr = newStatmgr(nil)
+		r, w := io.Pipe()
+		ch := make(chan interface{})
+		go cl.recvXml(r, ch, make(map[xml.Name]reflect.Type))
+		go func() {
+			io.WriteString(w, `<stream:stream xmlns="`+NsClient+
+				`" xmlns:stream="`+NsStream+`" version="1.0">`+
+				`<message xmlns="`+NsClient+`"/>`+end)
+			w.CloseWithError(closeErr)
+		}()
+		for range ch {
+		}
+		return cl.Err()
+	}
+	if err := read(`</stream:stream>`, errUnexpectedClose); err != nil {
+		t.Errorf("closed stream: %v", err)
+	}
+	if err := read(``, errShutdown); err != nil {
+		t.Errorf("shut down: %v", err)
+	}
+	if err := read(``, errUnexpectedClose); !errors.Is(err,
+		errUnexpectedClose) {
+		t.Errorf("unexpected close: %v", err)
+	}
+}
+
+type testElement struct {
+	XMLName xml.Name
+	Id      string `xml:"id,attr"`
+	Type    string `xml:"type,attr"`
+	Inner   string `xml:",innerxml"`
+}
+
+// Play the part of a server, just well enough for a client to log in.
+// What the client sends is reported on got. Once the client has sent
+// its presence, redirect it to other if that isn't empty.
+func testServe(ln net.Listener, other string, got chan<- string) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	p := xml.NewDecoder(conn)
+	features := `<stream:features><mechanisms xmlns="` + NsSASL +
+		`"><mechanism>PLAIN</mechanism></mechanisms></stream:features>`
+	for {
+		t, err := p.Token()
+		if err != nil {
+			return
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if se.Name.Local == "stream" {
+			fmt.Fprintf(conn, `<stream:stream xmlns="%s"`+
+				` xmlns:stream="%s" version="1.0">%s`,
+				NsClient, NsStream, features)
+			continue
+		}
+		var el testElement
+		if err := p.DecodeElement(&el, &se); err != nil {
+			return
+		}
+		switch {
+		case el.XMLName.Local == "auth":
+			got <- "auth"
+			features = `<stream:features><bind xmlns="` +
+				NsBind + `"/></stream:features>`
+			fmt.Fprintf(conn, `<success xmlns="%s"/>`, NsSASL)
+		case strings.Contains(el.Inner, NsBind):
+			fmt.Fprintf(conn, `<iq type="result" id="%s"><bind`+
+				` xmlns="%s"><jid>me@example.com/res</jid>`+
+				`</bind></iq>`, el.Id, NsBind)
+		case el.XMLName.Local == "iq":
+			if strings.Contains(el.Inner, NsSession) {
+				got <- "session"
+			}
+			fmt.Fprintf(conn, `<iq type="result" id="%s"/>`,
+				el.Id)
+		default:
+			got <- el.XMLName.Local
+			if el.XMLName.Local == "presence" && other != "" {
+				fmt.Fprintf(conn, `<stream:error>`+
+					`<see-other-host xmlns="%s">%s`+
+					`</see-other-host></stream:error>`+
+					`</stream:stream>`, NsStreams, other)
+				return
+			}
+		}
+	}
+}
+
+func TestRedirectWhileRunning(t *testing.T) {
+	var lns [2]net.Listener
+	for i := range lns {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Skip(err)
+		}
+		defer ln.Close()
+		lns[i] = ln
+	}
+	got0 := make(chan string, 10)
+	got1 := make(chan string, 10)
+	go testServe(lns[0], lns[1].Addr().String(), got0)
+	go testServe(lns[1], "", got1)
+
+	tcp, err := dialTcp(lns[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	jid := JID("me@example.com/res")
+	status := make(chan Status, 100)
+	cl, err := newClient(tcp, &jid, "secret", tls.Config{}, nil,
+		&ClientOptions{FollowRedirects: true}, Presence{}, status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	expect := func(got <-chan string, what ...string) {
+		for _, w := range what {
+			select {
+			case s := <-got:
+				if s != w {
+					t.Fatalf("got %s, expected %s", s, w)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("no %s", w)
+			}
+		}
+	}
+	expect(got0, "auth", "session", "presence")
+	expect(got1, "auth", "session", "presence")
+	cl.Send <- NewMessage("you@example.com", MessageChat, "hi")
+	expect(got1, "message")
+	if err := cl.Err(); err != nil {
+		t.Error(err)
+	}
+
+	// Extensions and the application hear that the session was
+	// replaced.
+	var redirected bool
+	for len(status) > 0 {
+		if <-status == StatusRedirected {
+			redirected = true
+		}
+	}
+	if !redirected {
+		t.Error("no StatusRedirected")
+	}
+}
+
+func TestRedirectNotFollowed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+	got := make(chan string, 10)
+	go testServe(ln, "other.example.com:5222", got)
+
+	tcp, err := dialTcp(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	jid := JID("me@example.com/res")
+	cl, err := newClient(tcp, &jid, "secret", tls.Config{}, nil, nil,
+		Presence{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if cl.password != "" {
+		t.Error("password kept")
+	}
+
+	// Without the password, the application has to connect to
+	// the other host itself.
+	select {
+	case <-cl.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("redirect ignored")
+	}
+	var se *StreamError
+	if !errors.As(cl.Err(), &se) || se.Condition != StreamSeeOtherHost ||
+		se.OtherHost != "other.example.com:5222" {
+		t.Errorf("error %v", cl.Err())
+	}
+}